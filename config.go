@@ -0,0 +1,570 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	datadog "github.com/DataDog/datadog-go/statsd"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// AppConfig ...
+type AppConfig struct {
+	Host          string        `yaml:"listen_host"`
+	Port          int           `yaml:"listen_port"`
+	Readers       int           `yaml:"readers"`
+	ReceiveBuffer int           `yaml:"receive_buffer"`
+	SocketPath    string        `yaml:"socket_path"`
+	SocketMode    string        `yaml:"socket_mode"`
+	Upstream      string        `yaml:"upstream"`
+	BufferSize    int           `yaml:"buffer_size"`
+	MTU           int           `yaml:"upstream_mtu"`
+	Workers       int           `yaml:"workers"`
+	QueueSize     int           `yaml:"queue_size"`
+	HTTPAddr      string        `yaml:"http_addr"`
+	RulesFile     string        `yaml:"rules_file"`
+	RulesWatch    time.Duration `yaml:"rules_watch"`
+	Debug         bool          `yaml:"debug"`
+
+	TCPPort        int           `yaml:"tcp_port"`
+	TCPMaxLine     int           `yaml:"tcp_max_line"`
+	TCPIdleTimeout time.Duration `yaml:"tcp_idle_timeout"`
+
+	TagConflict string `yaml:"tag_conflict"`
+	CounterMode string `yaml:"counter_mode"`
+
+	// RelayUnmatched forwards the metrics no rule matches unmodified, rather than dropping them
+	RelayUnmatched bool `yaml:"relay_unmatched"`
+
+	// Upstreams replace Upstream, BufferSize and MTU when given, they can only be set in the config file
+	Upstreams []UpstreamConfig `yaml:"upstreams,omitempty"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// UpstreamConfig is a named destination for the rewritten metrics, every enabled upstream gets all of them.
+// It's a single StatsD server at Address, or a pool of Backends sharing the metrics by consistent hashing.
+type UpstreamConfig struct {
+	Name       string          `yaml:"name"`
+	Address    string          `yaml:"address,omitempty"`
+	Backends   []BackendConfig `yaml:"backends,omitempty"`
+	BufferSize int             `yaml:"buffer_size,omitempty"` // defaults to buffer_size
+	MTU        int             `yaml:"mtu,omitempty"`         // defaults to upstream_mtu
+	Enabled    *bool           `yaml:"enabled,omitempty"`     // defaults to true
+
+	// HashTags shards by the metric name and its sorted tags, rather than the name alone
+	HashTags            bool          `yaml:"hash_tags,omitempty"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty"` // defaults to 10s
+}
+
+// BackendConfig is a StatsD server in the pool of an upstream
+type BackendConfig struct {
+	Address string `yaml:"address"`
+
+	// HealthCheck is a TCP address that accepts connections while the backend is up,
+	// the backend is never taken out of the pool without one
+	HealthCheck string `yaml:"health_check,omitempty"`
+}
+
+func (u UpstreamConfig) isEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// backends returns the pool of the upstream, or its address as a single backend
+func (u UpstreamConfig) backends() []BackendConfig {
+	if len(u.Backends) > 0 {
+		return u.Backends
+	}
+
+	return []BackendConfig{{Address: u.Address}}
+}
+
+// configOption is a setting that can be given as a command-line flag or an environment variable
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *AppConfig, value string) error
+	get   func(cfg *AppConfig) string
+
+	// isBool options can be given as a bare -flag
+	isBool bool
+}
+
+var configOptions = []configOption{
+	{
+		flag:  "listen-host",
+		env:   "LISTEN_HOST",
+		usage: "Host to listen for StatsD on",
+		set:   func(cfg *AppConfig, value string) error { cfg.Host = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.Host },
+	},
+	{
+		flag:  "listen-port",
+		env:   "LISTEN_PORT",
+		usage: "UDP port to listen for StatsD on",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.Port, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.Port) },
+	},
+	{
+		flag:  "readers",
+		env:   "READERS",
+		usage: "Number of UDP sockets reading StatsD packets, more than 1 uses SO_REUSEPORT (Linux only)",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.Readers, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.Readers) },
+	},
+	{
+		flag:  "receive-buffer",
+		env:   "RECEIVE_BUFFER",
+		usage: "Size of the kernel receive buffer (SO_RCVBUF) of each UDP socket in bytes, 0 for the system default",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.ReceiveBuffer, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.ReceiveBuffer) },
+	},
+	{
+		flag:  "socket-path",
+		env:   "SOCKET_PATH",
+		usage: "Path of a unix datagram socket to also listen for DogStatsD on, e.g. /var/run/datadog/dsd.socket",
+		set:   func(cfg *AppConfig, value string) error { cfg.SocketPath = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.SocketPath },
+	},
+	{
+		flag:  "socket-mode",
+		env:   "SOCKET_MODE",
+		usage: "Permissions of the unix datagram socket, in octal",
+		set:   func(cfg *AppConfig, value string) error { cfg.SocketMode = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.SocketMode },
+	},
+	{
+		flag:  "tcp-port",
+		env:   "TCP_PORT",
+		usage: "TCP port to also listen for newline-delimited StatsD on, 0 to disable",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.TCPPort, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.TCPPort) },
+	},
+	{
+		flag:  "tcp-max-line",
+		env:   "TCP_MAX_LINE",
+		usage: "Longest line accepted over TCP in bytes, longer lines are dropped",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.TCPMaxLine, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.TCPMaxLine) },
+	},
+	{
+		flag:  "tcp-idle-timeout",
+		env:   "TCP_IDLE_TIMEOUT",
+		usage: "Close TCP connections that send nothing for this long, 0 to keep them open",
+		set: func(cfg *AppConfig, value string) (err error) {
+			cfg.TCPIdleTimeout, err = time.ParseDuration(value)
+			return
+		},
+		get: func(cfg *AppConfig) string { return cfg.TCPIdleTimeout.String() },
+	},
+	{
+		flag:  "upstream",
+		env:   "UPSTREAM_ADDR",
+		usage: "Address of the DogStatsD server to forward metrics to",
+		set:   func(cfg *AppConfig, value string) error { cfg.Upstream = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.Upstream },
+	},
+	{
+		flag:  "buffer-size",
+		env:   "BUFFER_SIZE",
+		usage: "Number of lines buffered before sending a packet upstream",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.BufferSize, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.BufferSize) },
+	},
+	{
+		flag:  "upstream-mtu",
+		env:   "UPSTREAM_MTU",
+		usage: "Largest packet to send upstream, in bytes",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.MTU, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.MTU) },
+	},
+	{
+		flag:  "workers",
+		env:   "WORKERS",
+		usage: "Number of worker goroutines processing packets",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.Workers, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.Workers) },
+	},
+	{
+		flag:  "queue-size",
+		env:   "QUEUE_SIZE",
+		usage: "Number of packets queued for the workers before dropping",
+		set:   func(cfg *AppConfig, value string) (err error) { cfg.QueueSize, err = strconv.Atoi(value); return },
+		get:   func(cfg *AppConfig) string { return strconv.Itoa(cfg.QueueSize) },
+	},
+	{
+		flag:  "http-addr",
+		env:   "HTTP_ADDR",
+		usage: "Address for the HTTP server",
+		set:   func(cfg *AppConfig, value string) error { cfg.HTTPAddr = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.HTTPAddr },
+	},
+	{
+		flag:  "rules",
+		env:   "RULES_FILE",
+		usage: "Path to a YAML or JSON rules file (default: the built-in rules)",
+		set:   func(cfg *AppConfig, value string) error { cfg.RulesFile = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.RulesFile },
+	},
+	{
+		flag:  "rules-watch",
+		env:   "RULES_WATCH",
+		usage: "Poll the rules file for changes at this interval and reload it, 0 to disable",
+		set: func(cfg *AppConfig, value string) (err error) {
+			cfg.RulesWatch, err = time.ParseDuration(value)
+			return
+		},
+		get: func(cfg *AppConfig) string { return cfg.RulesWatch.String() },
+	},
+	{
+		flag:  "tag-conflict",
+		env:   "TAG_CONFLICT",
+		usage: "Which tag to keep when an incoming tag has the same key as a captured tag: rule, metric or both",
+		set:   func(cfg *AppConfig, value string) error { cfg.TagConflict = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.TagConflict },
+	},
+	{
+		flag:  "counter-mode",
+		env:   "COUNTER_MODE",
+		usage: "How to forward sampled counters: faithful (value and sample rate as received) or prescale (scaled by the sample rate, sent with rate 1)",
+		set:   func(cfg *AppConfig, value string) error { cfg.CounterMode = value; return nil },
+		get:   func(cfg *AppConfig) string { return cfg.CounterMode },
+	},
+	{
+		flag:  "relay-unmatched",
+		env:   "RELAY_UNMATCHED",
+		usage: "Forward metrics that no rule matches unmodified, instead of dropping them",
+		set: func(cfg *AppConfig, value string) (err error) {
+			cfg.RelayUnmatched, err = strconv.ParseBool(value)
+			return
+		},
+		get:    func(cfg *AppConfig) string { return strconv.FormatBool(cfg.RelayUnmatched) },
+		isBool: true,
+	},
+	{
+		flag:  "shutdown-timeout",
+		env:   "SHUTDOWN_TIMEOUT",
+		usage: "How long to wait for queued packets to be processed on shutdown",
+		set: func(cfg *AppConfig, value string) (err error) {
+			cfg.ShutdownTimeout, err = time.ParseDuration(value)
+			return
+		},
+		get: func(cfg *AppConfig) string { return cfg.ShutdownTimeout.String() },
+	},
+	{
+		flag:   "debug",
+		env:    "DEBUG",
+		usage:  "Enable debug logging",
+		set:    func(cfg *AppConfig, value string) (err error) { cfg.Debug, err = strconv.ParseBool(value); return },
+		get:    func(cfg *AppConfig) string { return strconv.FormatBool(cfg.Debug) },
+		isBool: true,
+	},
+}
+
+// flagValue records a flag given on the command line, so it can be applied after the config file and environment
+type flagValue struct {
+	value  string
+	isSet  bool
+	isBool bool
+	def    string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.def
+}
+
+// IsBoolFlag allows boolean options to be given as a bare -flag
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	f.isSet = true
+	return nil
+}
+
+func defaultConfig() AppConfig {
+	return AppConfig{
+		Host:       "0.0.0.0",
+		Port:       8126,
+		Readers:    1,
+		SocketMode: "0622",
+		Upstream:   "127.0.0.1:8125",
+		BufferSize: 10,
+		MTU:        datadog.OptimalPayloadSize,
+		Workers:    runtime.NumCPU(),
+		QueueSize:  10000,
+		HTTPAddr:   ":4200",
+
+		TCPMaxLine:     8192,
+		TCPIdleTimeout: 5 * time.Minute,
+
+		TagConflict: tagConflictRule,
+		CounterMode: counterModeFaithful,
+
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// loadConfig builds the configuration from, in order of precedence, command-line flags,
+// environment variables, the config file and the defaults
+func loadConfig(name string, args []string) (AppConfig, bool, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	printOnly := flags.Bool("print-config", false, "Print the effective configuration and exit")
+
+	cfg, err := parseConfig(flags, args)
+	return cfg, *printOnly, err
+}
+
+// parseConfig adds the config options to flags, which may have flags of their own, then builds
+// the configuration like loadConfig
+func parseConfig(flags *flag.FlagSet, args []string) (AppConfig, error) {
+	cfg := defaultConfig()
+
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML config file")
+
+	values := make([]*flagValue, len(configOptions))
+	for i, option := range configOptions {
+		values[i] = &flagValue{def: option.get(&cfg), isBool: option.isBool}
+		flags.Var(values[i], option.flag, fmt.Sprintf("%s (env: %s)", option.usage, option.env))
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("Could not read config file: %s", err)
+		}
+
+		// unknown keys are errors, so a misspelled setting doesn't silently keep its default
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("Could not parse config file %s: %s", *configFile, err)
+		}
+	}
+
+	// Nomad assigns the HTTP port dynamically, HTTP_ADDR still takes precedence
+	if port := os.Getenv("NOMAD_PORT_http"); port != "" {
+		cfg.HTTPAddr = ":" + port
+	}
+
+	for _, option := range configOptions {
+		value, ok := os.LookupEnv(option.env)
+		if !ok {
+			continue
+		}
+
+		if err := option.set(&cfg, value); err != nil {
+			return cfg, fmt.Errorf("Invalid value for %s: %s", option.env, err)
+		}
+	}
+
+	for i, option := range configOptions {
+		if !values[i].isSet {
+			continue
+		}
+
+		if err := option.set(&cfg, values[i].value); err != nil {
+			return cfg, fmt.Errorf("Invalid value for -%s: %s", option.flag, err)
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg AppConfig) validate() error {
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return fmt.Errorf("listen_port must be between 1 and 65535, got %d", cfg.Port)
+	}
+
+	if cfg.Readers < 1 {
+		return fmt.Errorf("readers must be at least 1, got %d", cfg.Readers)
+	}
+
+	if cfg.ReceiveBuffer < 0 {
+		return fmt.Errorf("receive_buffer can't be negative, got %d", cfg.ReceiveBuffer)
+	}
+
+	if mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("socket_mode must be octal permissions like 0622, got '%s'", cfg.SocketMode)
+	}
+
+	if cfg.TCPPort < 0 || cfg.TCPPort > 65535 {
+		return fmt.Errorf("tcp_port must be between 0 and 65535, got %d", cfg.TCPPort)
+	}
+
+	if cfg.TCPMaxLine < 16 || cfg.TCPMaxLine > UDP_MAX_PACKET_SIZE {
+		return fmt.Errorf("tcp_max_line must be between 16 and %d, got %d", UDP_MAX_PACKET_SIZE, cfg.TCPMaxLine)
+	}
+
+	if cfg.TCPIdleTimeout < 0 {
+		return fmt.Errorf("tcp_idle_timeout can't be negative, got %s", cfg.TCPIdleTimeout)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Upstream); err != nil {
+		return fmt.Errorf("upstream must be in format host:port: %s", err)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+		return fmt.Errorf("http_addr must be in format [host]:port: %s", err)
+	}
+
+	if cfg.BufferSize < 1 {
+		return fmt.Errorf("buffer_size must be at least 1, got %d", cfg.BufferSize)
+	}
+
+	if cfg.MTU < 512 || cfg.MTU > datadog.MaxUDPPayloadSize {
+		return fmt.Errorf("upstream_mtu must be between 512 and %d, got %d", datadog.MaxUDPPayloadSize, cfg.MTU)
+	}
+
+	if err := validateUpstreams(cfg.upstreams()); err != nil {
+		return err
+	}
+
+	if cfg.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", cfg.Workers)
+	}
+
+	if cfg.QueueSize < 1 {
+		return fmt.Errorf("queue_size must be at least 1, got %d", cfg.QueueSize)
+	}
+
+	switch cfg.TagConflict {
+	case tagConflictRule, tagConflictMetric, tagConflictBoth:
+	default:
+		return fmt.Errorf("tag_conflict must be one of rule, metric or both, got '%s'", cfg.TagConflict)
+	}
+
+	switch cfg.CounterMode {
+	case counterModeFaithful, counterModePrescale:
+	default:
+		return fmt.Errorf("counter_mode must be one of faithful or prescale, got '%s'", cfg.CounterMode)
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout can't be negative, got %s", cfg.ShutdownTimeout)
+	}
+
+	if cfg.RulesWatch < 0 {
+		return fmt.Errorf("rules_watch can't be negative, got %s", cfg.RulesWatch)
+	}
+
+	return nil
+}
+
+// upstreams returns the configured upstreams with their defaults applied, or a single upstream
+// named "default" from the upstream setting
+func (cfg AppConfig) upstreams() []UpstreamConfig {
+	if len(cfg.Upstreams) == 0 {
+		return []UpstreamConfig{{Name: "default", Address: cfg.Upstream, BufferSize: cfg.BufferSize, MTU: cfg.MTU}}
+	}
+
+	upstreams := make([]UpstreamConfig, len(cfg.Upstreams))
+	for i, upstream := range cfg.Upstreams {
+		if upstream.BufferSize == 0 {
+			upstream.BufferSize = cfg.BufferSize
+		}
+		if upstream.MTU == 0 {
+			upstream.MTU = cfg.MTU
+		}
+		if upstream.HealthCheckInterval == 0 {
+			upstream.HealthCheckInterval = 10 * time.Second
+		}
+		upstreams[i] = upstream
+	}
+
+	return upstreams
+}
+
+func validateUpstreams(upstreams []UpstreamConfig) error {
+	names := make(map[string]bool, len(upstreams))
+	enabled := 0
+
+	for i, upstream := range upstreams {
+		if upstream.Name == "" || strings.ContainsAny(upstream.Name, "/, @") {
+			return fmt.Errorf("upstreams[%d] must have a name without slashes, commas, spaces or @, got '%s'", i, upstream.Name)
+		}
+
+		if names[upstream.Name] {
+			return fmt.Errorf("upstreams[%d]: duplicate name '%s'", i, upstream.Name)
+		}
+		names[upstream.Name] = true
+
+		if upstream.Address != "" && len(upstream.Backends) > 0 {
+			return fmt.Errorf("upstream %s: can have an address or backends, not both", upstream.Name)
+		}
+
+		addresses := make(map[string]bool, len(upstream.Backends))
+		for _, backend := range upstream.backends() {
+			if _, _, err := net.SplitHostPort(backend.Address); err != nil {
+				return fmt.Errorf("upstream %s: address must be in format host:port: %s", upstream.Name, err)
+			}
+
+			if addresses[backend.Address] {
+				return fmt.Errorf("upstream %s: duplicate backend '%s'", upstream.Name, backend.Address)
+			}
+			addresses[backend.Address] = true
+
+			if backend.HealthCheck == "" {
+				continue
+			}
+
+			if _, _, err := net.SplitHostPort(backend.HealthCheck); err != nil {
+				return fmt.Errorf("upstream %s: health_check must be in format host:port: %s", upstream.Name, err)
+			}
+		}
+
+		if upstream.HealthCheckInterval < 0 {
+			return fmt.Errorf("upstream %s: health_check_interval can't be negative, got %s", upstream.Name, upstream.HealthCheckInterval)
+		}
+
+		if upstream.BufferSize < 1 {
+			return fmt.Errorf("upstream %s: buffer_size must be at least 1, got %d", upstream.Name, upstream.BufferSize)
+		}
+
+		if upstream.MTU < 512 || upstream.MTU > datadog.MaxUDPPayloadSize {
+			return fmt.Errorf("upstream %s: mtu must be between 512 and %d, got %d", upstream.Name, datadog.MaxUDPPayloadSize, upstream.MTU)
+		}
+
+		if upstream.isEnabled() {
+			enabled++
+		}
+	}
+
+	if enabled == 0 {
+		return errors.New("at least one upstream must be enabled")
+	}
+
+	return nil
+}
+
+// httpPort returns the port part of the HTTP address
+func (cfg AppConfig) httpPort() string {
+	_, port, _ := net.SplitHostPort(cfg.HTTPAddr)
+	return port
+}
+
+func printConfig(cfg AppConfig) {
+	out, err := yaml.Marshal(&cfg)
+	if err != nil {
+		logger.Fatalf("Could not marshal config: %s", err)
+	}
+
+	fmt.Print("---\n" + string(out))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		port     int
+		httpAddr string
+		relay    bool
+		err      string
+	}{
+		{name: "defaults", port: 8126, httpAddr: ":4200"},
+		{name: "file", file: "listen_port: 9000\nrelay_unmatched: true", port: 9000, httpAddr: ":4200", relay: true},
+		{name: "env over file", file: "listen_port: 9000", env: map[string]string{"LISTEN_PORT": "9001"}, port: 9001, httpAddr: ":4200"},
+		{
+			name: "flag over env",
+			file: "listen_port: 9000",
+			env:  map[string]string{"LISTEN_PORT": "9001"},
+			args: []string{"-listen-port", "9002"},
+			port: 9002, httpAddr: ":4200",
+		},
+		{
+			name:     "nomad port over file",
+			file:     "http_addr: :5000",
+			env:      map[string]string{"NOMAD_PORT_http": "6000"},
+			port:     8126,
+			httpAddr: ":6000",
+		},
+		{
+			name:     "env over nomad port",
+			env:      map[string]string{"NOMAD_PORT_http": "6000", "HTTP_ADDR": "127.0.0.1:7000"},
+			port:     8126,
+			httpAddr: "127.0.0.1:7000",
+		},
+		{
+			name:     "flag over nomad port",
+			env:      map[string]string{"NOMAD_PORT_http": "6000"},
+			args:     []string{"-http-addr", ":8000"},
+			port:     8126,
+			httpAddr: ":8000",
+		},
+		{name: "bare bool flag", args: []string{"-relay-unmatched"}, port: 8126, httpAddr: ":4200", relay: true},
+		{name: "bool flag over env", env: map[string]string{"RELAY_UNMATCHED": "true"}, args: []string{"-relay-unmatched=false"}, port: 8126, httpAddr: ":4200"},
+		{name: "bool env", env: map[string]string{"RELAY_UNMATCHED": "False"}, port: 8126, httpAddr: ":4200"},
+		{name: "invalid bool env", env: map[string]string{"RELAY_UNMATCHED": "no"}, err: "Invalid value for RELAY_UNMATCHED"},
+		{name: "invalid int flag", args: []string{"-listen-port", "x"}, err: "Invalid value for -listen-port"},
+		{name: "unknown key in file", file: "listen_prot: 9999", err: "field listen_prot not found"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, env := range []string{"CONFIG_FILE", "LISTEN_PORT", "HTTP_ADDR", "NOMAD_PORT_http", "RELAY_UNMATCHED"} {
+				// restored when the test ends
+				t.Setenv(env, "")
+				if value, ok := test.env[env]; ok {
+					os.Setenv(env, value)
+				} else {
+					os.Unsetenv(env)
+				}
+			}
+
+			args := test.args
+			if test.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := ioutil.WriteFile(path, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", path}, args...)
+			}
+
+			cfg, _, err := loadConfig("test", args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing '%s', got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if cfg.Port != test.port || cfg.HTTPAddr != test.httpAddr || cfg.RelayUnmatched != test.relay {
+				t.Errorf("expected port %d, HTTP address %s and relay_unmatched %t, got %d, %s and %t",
+					test.port, test.httpAddr, test.relay, cfg.Port, cfg.HTTPAddr, cfg.RelayUnmatched)
+			}
+		})
+	}
+}
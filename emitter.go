@@ -0,0 +1,501 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	datadog "github.com/DataDog/datadog-go/statsd"
+)
+
+const (
+	counterModeFaithful = "faithful" // forward counters with the value and sample rate as received
+	counterModePrescale = "prescale" // forward counters scaled by their sample rate, with rate 1
+
+	// emitterFlushInterval is how often buffered lines are sent, even if the buffer isn't full
+	emitterFlushInterval = 100 * time.Millisecond
+)
+
+// Emitter forwards metrics, events and service checks to every upstream. Metrics are written as
+// raw lines, with their value and sample rate as received, and the DogStatsD client of a backend
+// formats events and service checks. Both go through the same buffer, so lines are sent in the
+// order they were emitted.
+type Emitter struct {
+	upstreams   []*upstream
+	counterMode string
+	missing     int // named upstreams of a route that are disabled or not configured
+
+	routesLock sync.RWMutex
+	routes     map[string]*Emitter // by routeKey, emitters for a subset of the upstreams
+}
+
+// upstream is a destination for the rewritten metrics. It's either a single backend, or a pool
+// of backends sharing the metrics between them by the hash of their name (and tags).
+type upstream struct {
+	name     string
+	backends []*backend
+	ring     *hashRing // nil for a single backend
+	hashTags bool
+	stop     chan struct{}
+}
+
+// backend is a StatsD server, with its own client and buffer
+type backend struct {
+	*datadog.Client
+	address     string
+	buffer      *packetBuffer
+	healthCheck string // TCP address checked to tell if the backend is up, empty to never check
+	healthy     int32  // 1 when up, updated atomically
+}
+
+// NewEmitter connects to the enabled upstreams. Each backend gets a packet every buffer_size
+// lines, or sooner when the next line would make it larger than its MTU.
+func NewEmitter(cfg AppConfig) (*Emitter, error) {
+	emitter := &Emitter{counterMode: cfg.CounterMode}
+
+	for _, upstreamConfig := range cfg.upstreams() {
+		if !upstreamConfig.isEnabled() {
+			logger.Infof("Upstream %s is disabled", upstreamConfig.Name)
+			continue
+		}
+
+		u := &upstream{name: upstreamConfig.Name, hashTags: upstreamConfig.HashTags, stop: make(chan struct{})}
+		emitter.upstreams = append(emitter.upstreams, u)
+
+		for _, backendConfig := range upstreamConfig.backends() {
+			// a pool's backends are published as <upstream>@<address>
+			name := upstreamConfig.Name
+			if len(upstreamConfig.Backends) > 0 {
+				name = name + "@" + backendConfig.Address
+			}
+
+			b, err := dialBackend(name, backendConfig, upstreamConfig.BufferSize, upstreamConfig.MTU)
+			if err != nil {
+				emitter.Close()
+				return nil, fmt.Errorf("upstream %s: %s", upstreamConfig.Name, err)
+			}
+
+			u.backends = append(u.backends, b)
+		}
+
+		if len(upstreamConfig.Backends) > 0 {
+			u.ring = newHashRing(u.addresses())
+			go u.checkHealth(upstreamConfig.HealthCheckInterval)
+
+			logger.Infof("Sharding upstream %s between %s", upstreamConfig.Name, strings.Join(u.addresses(), ", "))
+		} else {
+			logger.Infof("Forwarding to upstream %s @ %s", upstreamConfig.Name, upstreamConfig.Address)
+		}
+	}
+
+	return emitter, nil
+}
+
+// dialBackend connects to a backend, name is what its send counters are published under
+func dialBackend(name string, cfg BackendConfig, bufferSize int, mtu int) (*backend, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamConn := newUpstreamConn(name, conn)
+	buffer := newPacketBuffer(upstreamConn, bufferSize, mtu)
+	go buffer.watch(emitterFlushInterval)
+
+	b, err := newBackend(cfg.Address, buffer)
+	if err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	b.healthCheck = cfg.HealthCheck
+
+	statNames = append(statNames, "upstreams/"+name+"/healthy")
+	upstreamConn.vars.Set("healthy", expvar.Func(func() interface{} {
+		return atomic.LoadInt32(&b.healthy)
+	}))
+
+	return b, nil
+}
+
+func newBackend(address string, buffer *packetBuffer) (*backend, error) {
+	client, err := datadog.NewWithWriter(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend{Client: client, address: address, buffer: buffer, healthy: 1}, nil
+}
+
+// newUpstream creates an upstream with a single backend writing to buffer
+func newUpstream(name string, buffer *packetBuffer) (*upstream, error) {
+	b, err := newBackend(name, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstream{name: name, backends: []*backend{b}, stop: make(chan struct{})}, nil
+}
+
+func (u *upstream) addresses() []string {
+	addresses := make([]string, len(u.backends))
+	for i, b := range u.backends {
+		addresses[i] = b.address
+	}
+
+	return addresses
+}
+
+// pick returns the backend for a metric, the same name (and tags) always gets the same backend
+// for as long as it's healthy
+func (u *upstream) pick(name string, tags []string) *backend {
+	if u.ring == nil {
+		return u.backends[0]
+	}
+
+	key := name
+	if u.hashTags && len(tags) > 0 {
+		sorted := append([]string{}, tags...)
+		sort.Strings(sorted)
+		key = name + "|#" + strings.Join(sorted, ",")
+	}
+
+	return u.backends[u.ring.get(key, u.isHealthy)]
+}
+
+func (u *upstream) isHealthy(i int) bool {
+	return atomic.LoadInt32(&u.backends[i].healthy) == 1
+}
+
+// Close stops the health checks, sends the buffered lines and closes the connection of every backend
+func (u *upstream) Close() error {
+	close(u.stop)
+
+	var first error
+	for _, b := range u.backends {
+		if err := b.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// route returns the emitter for the upstreams in destination, a routeKey, or e itself if it's empty.
+// Named upstreams that are disabled or not configured are left out, and what's sent to them is
+// counted as unrouted.
+func (e *Emitter) route(destination string) *Emitter {
+	if destination == "" {
+		return e
+	}
+
+	e.routesLock.RLock()
+	routed, ok := e.routes[destination]
+	e.routesLock.RUnlock()
+	if ok {
+		return routed
+	}
+
+	e.routesLock.Lock()
+	defer e.routesLock.Unlock()
+
+	if routed, ok := e.routes[destination]; ok {
+		return routed
+	}
+
+	routed = &Emitter{counterMode: e.counterMode}
+	for _, name := range strings.Split(destination, ",") {
+		found := false
+		for _, u := range e.upstreams {
+			if u.name == name {
+				routed.upstreams = append(routed.upstreams, u)
+				found = true
+			}
+		}
+
+		// routes are only built once, so this is only logged once
+		if !found {
+			routed.missing++
+			logger.Warnf("Rules send metrics to upstream %s, which is disabled or not configured, they won't be sent there", name)
+		}
+	}
+
+	if e.routes == nil {
+		e.routes = make(map[string]*Emitter)
+	}
+	e.routes[destination] = routed
+
+	return routed
+}
+
+// Metric forwards a metric under name with tags, in the format for its type
+func (e *Emitter) Metric(name string, metric *StatsDMetric, tags []string) error {
+	switch metric.metricType {
+	case "c":
+		if e.counterMode == counterModePrescale {
+			value := strconv.FormatFloat(metric.floatvalue/metric.samplerate, 'f', -1, 64)
+			return e.Raw(name, tags, formatLine(name, value, "c", "", tags))
+		}
+		return e.Raw(name, tags, formatLine(name, metric.rawvalue, "c", metric.rawrate, tags))
+	case "ms":
+		// timings are in milliseconds, and kept at full precision
+		return e.Raw(name, tags, formatLine(name, metric.rawvalue, "ms", metric.rawrate, tags))
+	case "g":
+		if metric.delta {
+			return e.Raw(name, tags, formatLine(name, formatGaugeDelta(metric.floatvalue), "g", metric.rawrate, tags))
+		}
+		return e.Raw(name, tags, formatLine(name, metric.rawvalue, "g", metric.rawrate, tags))
+	case "s", "h", "d":
+		// the client would sample these again and round their value, so they are sent as received
+		return e.Raw(name, tags, formatLine(name, metric.rawvalue, metric.metricType, metric.rawrate, tags))
+	default:
+		return errUnknownMetricType
+	}
+}
+
+// Event forwards an event
+func (e *Emitter) Event(event *datadog.Event) error {
+	return e.each(event.Title, event.Tags, func(b *backend) error { return b.Event(event) })
+}
+
+// ServiceCheck forwards a service check
+func (e *Emitter) ServiceCheck(check *datadog.ServiceCheck) error {
+	return e.each(check.Name, check.Tags, func(b *backend) error { return b.ServiceCheck(check) })
+}
+
+// Raw forwards a line exactly as given, name and tags pick the backend of a sharded upstream
+func (e *Emitter) Raw(name string, tags []string, line string) error {
+	return e.each(name, tags, func(b *backend) error {
+		_, err := b.buffer.WriteString(line)
+		return err
+	})
+}
+
+// Close sends the buffered lines and closes the connection of every backend
+func (e *Emitter) Close() error {
+	var first error
+	for _, u := range e.upstreams {
+		if err := u.Close(); err != nil && first == nil {
+			first = fmt.Errorf("upstream %s: %s", u.name, err)
+		}
+	}
+
+	return first
+}
+
+// each calls send with the backend of every upstream for a metric, a failing upstream doesn't
+// keep the others from being sent to. It returns the first error.
+func (e *Emitter) each(name string, tags []string, send func(b *backend) error) error {
+	if e.missing > 0 {
+		counterUnrouted.Add(int64(e.missing))
+	}
+
+	var first error
+	for _, u := range e.upstreams {
+		if err := send(u.pick(name, tags)); err != nil && first == nil {
+			first = fmt.Errorf("upstream %s: %s", u.name, err)
+		}
+	}
+
+	return first
+}
+
+// formatLine formats a metric in the DogStatsD wire format, rate is left out when empty
+func formatLine(name string, value string, metricType string, rate string, tags []string) string {
+	line := name + ":" + value + "|" + metricType
+	if rate != "" {
+		line = line + "|@" + rate
+	}
+	if len(tags) > 0 {
+		line = line + "|#" + strings.Join(tags, ",")
+	}
+
+	return line
+}
+
+// formatGaugeDelta formats a relative gauge update, which always has a sign, even when it's +0 or -0
+func formatGaugeDelta(value float64) string {
+	sign := "+"
+	if math.Signbit(value) {
+		sign = "-"
+	}
+
+	return sign + strconv.FormatFloat(math.Abs(value), 'f', -1, 64)
+}
+
+// counterUnrouted counts the metrics not sent to an upstream named by their rule, as it's disabled or not configured
+var counterUnrouted = newCounter("metrics_unrouted")
+
+// upstreamVars are the send counters of every upstream, published through expvar
+var upstreamVars = expvar.NewMap("upstreams")
+
+// upstreamConn counts the packets sent to an upstream, and the errors sending them
+type upstreamConn struct {
+	io.WriteCloser
+	vars *expvar.Map
+}
+
+func newUpstreamConn(name string, conn io.WriteCloser) *upstreamConn {
+	vars := new(expvar.Map).Init()
+	for _, counter := range []string{"packets_sent", "bytes_sent", "send_errors"} {
+		vars.Add(counter, 0)
+		statNames = append(statNames, "upstreams/"+name+"/"+counter)
+	}
+	upstreamVars.Set(name, vars)
+
+	return &upstreamConn{WriteCloser: conn, vars: vars}
+}
+
+func (c *upstreamConn) Write(packet []byte) (int, error) {
+	n, err := c.WriteCloser.Write(packet)
+	if err != nil {
+		c.vars.Add("send_errors", 1)
+		return n, err
+	}
+
+	c.vars.Add("packets_sent", 1)
+	c.vars.Add("bytes_sent", int64(n))
+
+	return n, nil
+}
+
+// packetBuffer joins lines into packets of at most maxLines lines and maxSize bytes.
+// It's the writer of the DogStatsD client, which sends it one line at a time.
+type packetBuffer struct {
+	sync.Mutex
+	conn     io.WriteCloser
+	buf      []byte
+	lines    int
+	maxLines int
+	maxSize  int
+	stop     chan struct{}
+}
+
+func newPacketBuffer(conn io.WriteCloser, maxLines int, maxSize int) *packetBuffer {
+	return &packetBuffer{
+		conn:     conn,
+		buf:      make([]byte, 0, maxSize),
+		maxLines: maxLines,
+		maxSize:  maxSize,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Write buffers a line, sending the buffer first if the line doesn't fit in the same packet
+func (b *packetBuffer) Write(line []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.reserveLocked(len(line)); err != nil {
+		return 0, err
+	}
+	b.buf = append(b.buf, line...)
+
+	return len(line), b.addedLocked()
+}
+
+// WriteString is Write without copying the line to a byte slice first
+func (b *packetBuffer) WriteString(line string) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.reserveLocked(len(line)); err != nil {
+		return 0, err
+	}
+	b.buf = append(b.buf, line...)
+
+	return len(line), b.addedLocked()
+}
+
+// reserveLocked makes room for a line of length n, sending the buffer if it doesn't fit
+func (b *packetBuffer) reserveLocked(n int) error {
+	if b.lines > 0 && len(b.buf)+1+n > b.maxSize {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	if b.lines > 0 {
+		b.buf = append(b.buf, '\n')
+	}
+
+	return nil
+}
+
+// addedLocked counts a line appended to the buffer, sending the buffer once it has enough lines
+func (b *packetBuffer) addedLocked() error {
+	b.lines = b.lines + 1
+
+	if b.lines >= b.maxLines {
+		return b.flushLocked()
+	}
+
+	return nil
+}
+
+// SetWriteTimeout is not supported for UDP
+func (b *packetBuffer) SetWriteTimeout(time.Duration) error {
+	return errors.New("SetWriteTimeout: not supported for UDP connections")
+}
+
+// Flush sends the buffered lines
+func (b *packetBuffer) Flush() error {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.flushLocked()
+}
+
+func (b *packetBuffer) flushLocked() error {
+	if b.lines == 0 {
+		return nil
+	}
+
+	_, err := b.conn.Write(b.buf)
+	b.buf = b.buf[:0]
+	b.lines = 0
+
+	return err
+}
+
+// watch sends the buffered lines at every interval, until the buffer is closed
+func (b *packetBuffer) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				logger.Errorf("Could not send metrics upstream: %s", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close sends the buffered lines and closes the connection
+func (b *packetBuffer) Close() error {
+	close(b.stop)
+
+	if err := b.Flush(); err != nil {
+		b.conn.Close()
+		return err
+	}
+
+	return b.conn.Close()
+}
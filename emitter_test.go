@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// packetRecorder keeps the packets written to it, or fails every write with err
+type packetRecorder struct {
+	packets []string
+	err     error
+}
+
+func (r *packetRecorder) Write(data []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	r.packets = append(r.packets, string(data))
+	return len(data), nil
+}
+
+func (r *packetRecorder) Close() error {
+	return nil
+}
+
+// newTestEmitter creates an emitter with an upstream for each name, or a single default upstream,
+// sending packets of at most bufferSize lines to the returned recorders
+func newTestEmitter(t testing.TB, bufferSize int, names ...string) (*Emitter, []*packetRecorder) {
+	if len(names) == 0 {
+		names = []string{"default"}
+	}
+
+	emitter := &Emitter{counterMode: counterModeFaithful}
+	recorders := make([]*packetRecorder, len(names))
+
+	for i, name := range names {
+		recorders[i] = &packetRecorder{}
+
+		u, err := newUpstream(name, newPacketBuffer(recorders[i], bufferSize, 1432))
+		if err != nil {
+			t.Fatal(err)
+		}
+		emitter.upstreams = append(emitter.upstreams, u)
+	}
+
+	return emitter, recorders
+}
+
+func TestEmitterMetric(t *testing.T) {
+	tests := []struct {
+		line     string
+		mode     string
+		times    int // how many times the line is emitted, once if 0
+		expected []string
+	}{
+		{line: "a.b:12.5|g", expected: []string{"a.b:12.5|g"}},
+		{line: "a.b:+2|g", expected: []string{"a.b:+2|g"}},
+		{line: "a.b:-2.5|g|@0.5|#env:prod", expected: []string{"a.b:-2.5|g|@0.5|#env:prod"}},
+		{line: "a.b:+0|g", expected: []string{"a.b:+0|g"}},
+		{line: "a.b:-0|g", expected: []string{"a.b:-0|g"}},
+		// statsd can only set a negative gauge by zeroing it first
+		{line: "a.b:0|g:-5|g", expected: []string{"a.b:0|g", "a.b:-5|g"}},
+
+		// sampled metrics were already sampled by the client, every one of them is forwarded as received
+		{line: "a.b:12.5|d", times: 100, expected: []string{"a.b:12.5|d"}},
+		{line: "a.b:0.1234567|h|@0.1", times: 100, expected: []string{"a.b:0.1234567|h|@0.1"}},
+		{line: "a.b:3|g|@0.5|#env:prod", times: 100, expected: []string{"a.b:3|g|@0.5|#env:prod"}},
+		{line: "a.b:abc|s|@0.25", times: 100, expected: []string{"a.b:abc|s|@0.25"}},
+
+		{line: "a.b:1|c|@0.1", mode: counterModeFaithful, expected: []string{"a.b:1|c|@0.1"}},
+		{line: "a.b:1.5|c|@.25|#env:prod", mode: counterModeFaithful, expected: []string{"a.b:1.5|c|@.25|#env:prod"}},
+		{line: "a.b:3|c", mode: counterModeFaithful, expected: []string{"a.b:3|c"}},
+		{line: "a.b:1|c|@0.1", mode: counterModePrescale, expected: []string{"a.b:10|c"}},
+		{line: "a.b:1.5|c|@.25|#env:prod", mode: counterModePrescale, expected: []string{"a.b:6|c|#env:prod"}},
+		{line: "a.b:1|c|@0.3", mode: counterModePrescale, expected: []string{"a.b:3.3333333333333335|c"}},
+		{line: "a.b:-2|c", mode: counterModePrescale, expected: []string{"a.b:-2|c"}},
+
+		// timings are kept at full precision
+		{line: "x:12.5|ms", expected: []string{"x:12.5|ms"}},
+		{line: "x:320|ms|@0.1", mode: counterModePrescale, expected: []string{"x:320|ms|@0.1"}},
+		{line: "x:0.001|ms|#env:prod", expected: []string{"x:0.001|ms|#env:prod"}},
+		{line: "x:1500000|ms", expected: []string{"x:1500000|ms"}},
+	}
+
+	for _, test := range tests {
+		emitter, recorders := newTestEmitter(t, 1)
+		if test.mode != "" {
+			emitter.counterMode = test.mode
+		}
+
+		metrics, err := parsePacketString(test.line)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.line, err)
+			continue
+		}
+
+		times := test.times
+		if times == 0 {
+			times = 1
+		}
+
+		expected := make([]string, 0, times*len(test.expected))
+		for i := 0; i < times; i++ {
+			for _, metric := range metrics {
+				if err := emitter.Metric(metric.name, metric, metric.tags); err != nil {
+					t.Errorf("%s: unexpected error: %s", test.line, err)
+				}
+			}
+			expected = append(expected, test.expected...)
+		}
+		emitter.Close()
+
+		if !reflect.DeepEqual(recorders[0].packets, expected) {
+			t.Errorf("%s (%s): expected %q, got %q", test.line, emitter.counterMode, expected, recorders[0].packets)
+		}
+	}
+}
+
+func TestPacketBuffer(t *testing.T) {
+	recorder := &packetRecorder{}
+	buffer := newPacketBuffer(recorder, 3, 12)
+
+	for _, line := range []string{"a:1|c", "b:1|c", "c:1|c", "d:1|c", "e:1|c", "f:1|c", "g:1|c"} {
+		buffer.Write([]byte(line))
+	}
+	buffer.Close()
+
+	// packets are cut at 12 bytes, and at 3 lines
+	expected := []string{"a:1|c\nb:1|c", "c:1|c\nd:1|c", "e:1|c\nf:1|c", "g:1|c"}
+	if !reflect.DeepEqual(recorder.packets, expected) {
+		t.Errorf("expected %q, got %q", expected, recorder.packets)
+	}
+
+	recorder.packets = nil
+	buffer = newPacketBuffer(recorder, 3, 1432)
+	for _, line := range []string{"a:1|c", "b:1|c", "c:1|c", "d:1|c"} {
+		buffer.Write([]byte(line))
+	}
+	buffer.Close()
+
+	expected = []string{"a:1|c\nb:1|c\nc:1|c", "d:1|c"}
+	if !reflect.DeepEqual(recorder.packets, expected) {
+		t.Errorf("expected %q, got %q", expected, recorder.packets)
+	}
+}
+
+func TestEmitterFanOut(t *testing.T) {
+	emitter, recorders := newTestEmitter(t, 1, "0", "1", "2")
+	recorders[1].err = errors.New("connection refused")
+
+	metrics, _ := parsePacketString("a.b:1|c:2|g:3|h")
+	for _, metric := range metrics {
+		if err := emitter.Metric(metric.name, metric, nil); err == nil || !strings.Contains(err.Error(), "upstream 1") {
+			t.Errorf("expected an error from upstream 1, got %v", err)
+		}
+	}
+	emitter.Close()
+
+	// a failing upstream doesn't keep the others from getting every metric
+	expected := []string{"a.b:1|c", "a.b:2|g", "a.b:3|h"}
+	for _, i := range []int{0, 2} {
+		if recorder := recorders[i]; !reflect.DeepEqual(recorder.packets, expected) {
+			t.Errorf("upstream %d: expected %q, got %q", i, expected, recorder.packets)
+		}
+	}
+}
+
+func TestEmitterRouteMissing(t *testing.T) {
+	emitter, recorders := newTestEmitter(t, 1, "datadog", "aggregator")
+	before := counterUnrouted.Value()
+
+	// legacy is disabled, so it isn't one of the upstreams
+	routed := emitter.route(routeKey([]string{"legacy", "aggregator"}))
+	if routed != emitter.route(routeKey([]string{"aggregator", "legacy"})) {
+		t.Error("expected the route to be reused")
+	}
+
+	metrics, _ := parsePacketString("a.b:1|c:2|c")
+	for _, metric := range metrics {
+		if err := routed.Metric(metric.name, metric, nil); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	emitter.Close()
+
+	if unrouted := counterUnrouted.Value() - before; unrouted != 2 {
+		t.Errorf("expected 2 unrouted metrics, got %d", unrouted)
+	}
+	if len(recorders[0].packets) != 0 || len(recorders[1].packets) != 2 {
+		t.Errorf("expected every metric sent to aggregator only, got %q and %q", recorders[0].packets, recorders[1].packets)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packetErrorParseFailure  = "parse_failure"
+	packetErrorUnknownType   = "unknown_type"
+	packetErrorUnknownAction = "unknown_action"
+
+	// packetErrorSamples is how many offending packets are kept for /errors
+	packetErrorSamples = 100
+
+	// packetErrorMaxLength is how much of an offending packet is kept
+	packetErrorMaxLength = 1024
+)
+
+// errUnknownMetricType is returned when forwarding a metric of a type the proxy doesn't know
+var errUnknownMetricType = errors.New("Unknown metric type")
+
+var (
+	packetErrorCounters = map[string]*expvar.Int{
+		packetErrorParseFailure:  newCounter("errors_parse_failure"),
+		packetErrorUnknownType:   newCounter("errors_unknown_type"),
+		packetErrorUnknownAction: newCounter("errors_unknown_action"),
+	}
+
+	recentPacketErrors = &packetErrorLog{size: packetErrorSamples}
+)
+
+// PacketError is an offending packet line, and why it couldn't be handled
+type PacketError struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+	Packet string    `json:"packet"`
+}
+
+// packetErrorLog is a ring buffer of the latest packet errors
+type packetErrorLog struct {
+	sync.Mutex
+	entries []PacketError
+	next    int
+	size    int
+}
+
+func (l *packetErrorLog) add(entry PacketError) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, entry)
+		return
+	}
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % l.size
+}
+
+// list returns a copy of the entries, oldest first
+func (l *packetErrorLog) list() []PacketError {
+	l.Lock()
+	defer l.Unlock()
+
+	entries := make([]PacketError, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	return append(entries, l.entries[:l.next]...)
+}
+
+// recordPacketError counts a packet line that couldn't be handled by reason, and samples it for /errors
+func recordPacketError(reason string, err error, line string) {
+	packetErrorCounters[reason].Add(1)
+
+	if len(line) > packetErrorMaxLength {
+		line = line[:packetErrorMaxLength]
+	}
+	// the line is part of a packet, keep a copy so the packet can be freed
+	line = strings.Clone(line)
+
+	recentPacketErrors.add(PacketError{
+		Time:   time.Now(),
+		Reason: reason,
+		Error:  err.Error(),
+		Packet: line,
+	})
+}
+
+// showPacketErrors lists the latest packet errors, oldest first
+func showPacketErrors(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int64, len(packetErrorCounters))
+	for reason, counter := range packetErrorCounters {
+		counts[reason] = counter.Value()
+	}
+
+	response := struct {
+		Counts map[string]int64 `json:"counts"`
+		Recent []PacketError    `json:"recent"`
+	}{
+		Counts: counts,
+		Recent: recentPacketErrors.list(),
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
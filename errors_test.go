@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPacketErrorLog(t *testing.T) {
+	log := &packetErrorLog{size: 3}
+
+	packets := func() []string {
+		list := make([]string, 0)
+		for _, entry := range log.list() {
+			list = append(list, entry.Packet)
+		}
+		return list
+	}
+
+	if got := packets(); len(got) != 0 {
+		t.Errorf("expected no entries, got %v", got)
+	}
+
+	log.add(PacketError{Packet: "a"})
+	log.add(PacketError{Packet: "b"})
+	if got, expected := packets(), []string{"a", "b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	log.add(PacketError{Packet: "c"})
+	log.add(PacketError{Packet: "d"})
+	log.add(PacketError{Packet: "e"})
+	if got, expected := packets(), []string{"c", "d", "e"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	log.add(PacketError{Packet: "f"})
+	if got, expected := packets(), []string{"d", "e", "f"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
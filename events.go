@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	datadog "github.com/DataDog/datadog-go/statsd"
+)
+
+const (
+	eventPrefix        = "_e{"
+	serviceCheckPrefix = "_sc|"
+)
+
+// isEventOrServiceCheck tells if a line is a DogStatsD event or service check rather than a metric
+func isEventOrServiceCheck(line string) bool {
+	return strings.HasPrefix(line, eventPrefix) || strings.HasPrefix(line, serviceCheckPrefix)
+}
+
+// processEventOrServiceCheck runs an event (by title) or service check (by name) through the rules,
+// adding the captured tags if a "match" rule matched, and forwards it unless a "drop" rule matched
+func processEventOrServiceCheck(emitter *Emitter, ruleSet *Rules, line string, workerID int) error {
+	if strings.HasPrefix(line, eventPrefix) {
+		event, err := parseEventString(line)
+		if err != nil {
+			return err
+		}
+
+		counterEvents.Add(1)
+
+		var destination string
+		var forward bool
+		if event.Tags, destination, forward = resolveEventTags(ruleSet, event.Title, event.Tags, workerID); !forward {
+			return nil
+		}
+
+		return emitter.route(destination).Event(event)
+	}
+
+	check, err := parseServiceCheckString(line)
+	if err != nil {
+		return err
+	}
+
+	counterServiceChecks.Add(1)
+
+	var destination string
+	var forward bool
+	if check.Tags, destination, forward = resolveEventTags(ruleSet, check.Name, check.Tags, workerID); !forward {
+		return nil
+	}
+
+	return emitter.route(destination).ServiceCheck(check)
+}
+
+// resolveEventTags returns the tags and upstreams to forward an event or service check with,
+// or false if it should be dropped
+func resolveEventTags(ruleSet *Rules, name string, tags []string, workerID int) ([]string, string, bool) {
+	_, result := ruleSet.Resolve(name)
+
+	switch result.action {
+	case ruleActionDrop:
+		counterEventsDropped.Add(1)
+		return nil, "", false
+
+	case ruleActionMatch:
+		if debug {
+			logger.Debugf("[%d] Found match for '%s', adding tags %v", workerID, name, result.Tags)
+		}
+
+		return mergeTags(tags, result.Tags, config.TagConflict), result.destination, true
+	}
+
+	// events are never renamed, so anything else is forwarded as-is
+	return tags, result.destination, true
+}
+
+// parseEventString parses a DogStatsD event, in the format
+// _e{<TITLE_LENGTH>,<TEXT_LENGTH>}:<TITLE>|<TEXT>|d:<TIMESTAMP>|h:<HOSTNAME>|k:<AGGREGATION_KEY>|p:<PRIORITY>|s:<SOURCE_TYPE>|t:<ALERT_TYPE>|#<TAGS>
+func parseEventString(line string) (*datadog.Event, error) {
+	colon := strings.Index(line, "}:")
+	if colon < 0 {
+		logger.Errorf("Error: missing '}:', Unable to parse event: %s\n", line)
+		return nil, errors.New("Error Parsing statsd event")
+	}
+
+	var titleLength, textLength int
+	if _, err := fmt.Sscanf(line[:colon+1], "_e{%d,%d}", &titleLength, &textLength); err != nil || titleLength < 1 || textLength < 1 {
+		logger.Errorf("Error: parsing lengths, Unable to parse event: %s\n", line)
+		return nil, errors.New("Error Parsing statsd event")
+	}
+
+	rest := line[colon+2:]
+	if len(rest) < titleLength+1+textLength || rest[titleLength] != '|' {
+		logger.Errorf("Error: title and text don't match their lengths, Unable to parse event: %s\n", line)
+		return nil, errors.New("Error Parsing statsd event")
+	}
+
+	event := &datadog.Event{
+		Title: rest[:titleLength],
+		Text:  strings.Replace(rest[titleLength+1:titleLength+1+textLength], "\\n", "\n", -1),
+	}
+
+	rest = rest[titleLength+1+textLength:]
+	if rest == "" {
+		return event, nil
+	}
+
+	if rest[0] != '|' {
+		logger.Errorf("Error: text doesn't match its length, Unable to parse event: %s\n", line)
+		return nil, errors.New("Error Parsing statsd event")
+	}
+
+	for _, section := range strings.Split(rest[1:], "|") {
+		switch {
+		case strings.HasPrefix(section, "#"):
+			event.Tags = appendTags(event.Tags, section[1:])
+		case strings.HasPrefix(section, "d:"):
+			timestamp, err := strconv.ParseInt(section[2:], 10, 64)
+			if err != nil {
+				logger.Errorf("Error: parsing timestamp, Unable to parse event: %s\n", line)
+				return nil, errors.New("Error Parsing statsd event")
+			}
+			event.Timestamp = time.Unix(timestamp, 0)
+		case strings.HasPrefix(section, "h:"):
+			event.Hostname = section[2:]
+		case strings.HasPrefix(section, "k:"):
+			event.AggregationKey = section[2:]
+		case strings.HasPrefix(section, "p:"):
+			event.Priority = datadog.EventPriority(section[2:])
+		case strings.HasPrefix(section, "s:"):
+			event.SourceTypeName = section[2:]
+		case strings.HasPrefix(section, "t:"):
+			event.AlertType = datadog.EventAlertType(section[2:])
+		default:
+			logger.Errorf("Ignoring unknown section '%s' in event: %s\n", section, line)
+		}
+	}
+
+	return event, nil
+}
+
+// parseServiceCheckString parses a DogStatsD service check, in the format
+// _sc|<NAME>|<STATUS>|d:<TIMESTAMP>|h:<HOSTNAME>|#<TAGS>|m:<MESSAGE>
+func parseServiceCheckString(line string) (*datadog.ServiceCheck, error) {
+	sections := strings.Split(line, "|")
+	if len(sections) < 3 || sections[1] == "" {
+		logger.Errorf("Error: splitting '|', Unable to parse service check: %s\n", line)
+		return nil, errors.New("Error Parsing statsd service check")
+	}
+
+	status, err := strconv.Atoi(sections[2])
+	if err != nil || status < 0 || status > 3 {
+		logger.Errorf("Error: status must be 0, 1, 2 or 3, Unable to parse service check: %s\n", line)
+		return nil, errors.New("Error Parsing statsd service check")
+	}
+
+	check := &datadog.ServiceCheck{
+		Name:   sections[1],
+		Status: datadog.ServiceCheckStatus(status),
+	}
+
+	for i, section := range sections[3:] {
+		switch {
+		case strings.HasPrefix(section, "#"):
+			check.Tags = appendTags(check.Tags, section[1:])
+		case strings.HasPrefix(section, "d:"):
+			timestamp, err := strconv.ParseInt(section[2:], 10, 64)
+			if err != nil {
+				logger.Errorf("Error: parsing timestamp, Unable to parse service check: %s\n", line)
+				return nil, errors.New("Error Parsing statsd service check")
+			}
+			check.Timestamp = time.Unix(timestamp, 0)
+		case strings.HasPrefix(section, "h:"):
+			check.Hostname = section[2:]
+		case strings.HasPrefix(section, "m:"):
+			// the message is always the last section, and may contain "|"
+			message := strings.Join(sections[3+i:], "|")[2:]
+			message = strings.Replace(message, "\\n", "\n", -1)
+			check.Message = strings.Replace(message, `m\:`, "m:", -1)
+			return check, nil
+		default:
+			logger.Errorf("Ignoring unknown section '%s' in service check: %s\n", section, line)
+		}
+	}
+
+	return check, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	datadog "github.com/DataDog/datadog-go/statsd"
+)
+
+func TestParseEventString(t *testing.T) {
+	tests := []struct {
+		line  string
+		event *datadog.Event
+	}{
+		{line: "_e{5,4}:title|text", event: &datadog.Event{Title: "title", Text: "text"}},
+		{line: "_e{5,9}:title|text|more", event: &datadog.Event{Title: "title", Text: "text|more"}},
+		{line: "_e{5,10}:title|line\\nline", event: &datadog.Event{Title: "title", Text: "line\nline"}},
+		{line: "_e{5,4}:title|text|d:1500000000|h:web-1|k:deploy|p:low|s:nomad|t:warning|#env:prod,role", event: &datadog.Event{
+			Title:          "title",
+			Text:           "text",
+			Timestamp:      time.Unix(1500000000, 0),
+			Hostname:       "web-1",
+			AggregationKey: "deploy",
+			Priority:       datadog.Low,
+			SourceTypeName: "nomad",
+			AlertType:      datadog.Warning,
+			Tags:           []string{"env:prod", "role"},
+		}},
+		{line: "_e{5,4}:title"},
+		{line: "_e{5,4}:titl|text"},
+		{line: "_e{5,4}:title|textt"},
+		{line: "_e{a,4}:title|text"},
+		{line: "_e{0,4}:|text"},
+		{line: "_e{5,4}:title|text|d:soon"},
+	}
+
+	for _, test := range tests {
+		event, err := parseEventString(test.line)
+
+		if test.event == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.line)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(event, test.event) {
+			t.Errorf("%s: expected %+v, got %+v", test.line, test.event, event)
+		}
+	}
+}
+
+func TestParseServiceCheckString(t *testing.T) {
+	tests := []struct {
+		line  string
+		check *datadog.ServiceCheck
+	}{
+		{line: "_sc|nomad.up|0", check: &datadog.ServiceCheck{Name: "nomad.up", Status: datadog.Ok}},
+		{line: "_sc|nomad.up|2|d:1500000000|h:web-1|#env:prod|m:down|again\\nm\\: yes", check: &datadog.ServiceCheck{
+			Name:      "nomad.up",
+			Status:    datadog.Critical,
+			Timestamp: time.Unix(1500000000, 0),
+			Hostname:  "web-1",
+			Tags:      []string{"env:prod"},
+			Message:   "down|again\nm: yes",
+		}},
+		{line: "_sc|nomad.up"},
+		{line: "_sc||0"},
+		{line: "_sc|nomad.up|4"},
+		{line: "_sc|nomad.up|ok"},
+	}
+
+	for _, test := range tests {
+		check, err := parseServiceCheckString(test.line)
+
+		if test.check == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.line)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(check, test.check) {
+			t.Errorf("%s: expected %+v, got %+v", test.line, test.check, check)
+		}
+	}
+}
@@ -1,43 +1,49 @@
 package main
 
 import (
-	"expvar"
 	"fmt"
 	"net/http"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-var (
-	ruleHitsSuccess = expvar.NewInt("rule_hits_success")
-	ruleHitsMiss    = expvar.NewInt("rule_hits_miss")
-)
+var httpServer = &http.Server{}
 
 func startHTTPServer() {
-	logger.Infof("Starting HTTP server @ :%s", listenPortHTTP)
+	logger.Infof("Starting HTTP server @ %s", config.HTTPAddr)
 	http.HandleFunc("/datadog/expvar", showExprVar)
-	http.ListenAndServe(":"+listenPortHTTP, nil)
+	http.HandleFunc("/rules", showRuleStats)
+	http.HandleFunc("/rules/reload", showReloadStatus)
+	http.HandleFunc("/errors", showPacketErrors)
+	http.HandleFunc("/tcp", showTCPConnections)
+	http.Handle("/ingest", ingest)
+
+	httpServer.Addr = config.HTTPAddr
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("HTTP server failed: %s", err)
+	}
 }
 
 func showExprVar(w http.ResponseWriter, r *http.Request) {
 	metrics := make([]map[string]string, 0)
-	metrics = append(metrics, map[string]string{"path": "rule_hits_success"})
-	metrics = append(metrics, map[string]string{"path": "rule_hits_miss"})
+	for _, name := range statNames {
+		metrics = append(metrics, map[string]string{"path": name})
+	}
 
-	config := struct {
+	view := struct {
 		ExpvarURL string              `yaml:"expvar_url"`
 		Tags      []string            `yaml:"tags"`
 		Metrics   []map[string]string `yaml:"metrics"`
 	}{
-		"http://127.0.0.1:" + listenPortHTTP + "/debug/vars",
+		"http://127.0.0.1:" + config.httpPort() + "/debug/vars",
 		[]string{"project:statsd-rewrite-proxy"},
 		metrics,
 	}
 
-	resp, err := yaml.Marshal(&config)
+	resp, err := yaml.Marshal(&view)
 	if err != nil {
 		message := fmt.Sprintf("[showExprVar] Could not marshal YAML: %s", err)
-		logger.Errorf(message)
+		logger.Error(message)
 		http.Error(w, message, 500)
 		return
 	}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ingestMaxBodySize is the largest body accepted by /ingest
+const ingestMaxBodySize = 1024 * 1024
+
+var (
+	counterIngestAccepted = newCounter("ingest_lines_accepted")
+	counterIngestRejected = newCounter("ingest_lines_rejected")
+)
+
+// ingest is the listener behind POST /ingest, on the HTTP server
+var ingest = newIngestListener()
+
+// ingestListener queues the lines POSTed to /ingest for the workers. It's a Listener so it
+// stops queueing, and waits for the requests in flight, before the queue is closed on shutdown.
+type ingestListener struct {
+	sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// IngestMetric is a metric in a JSON batch
+type IngestMetric struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	Rate  float64         `json:"rate"`
+	Tags  []string        `json:"tags"`
+}
+
+// IngestResult is whether a line (or JSON metric, as a line) was accepted
+type IngestResult struct {
+	Line     string `json:"line"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newIngestListener() *ingestListener {
+	return &ingestListener{done: make(chan struct{})}
+}
+
+// Serve waits for the listener to be closed, the requests are served by the HTTP server
+func (l *ingestListener) Serve() {
+	defer listenersDone.Done()
+
+	<-l.done
+}
+
+// Close rejects new requests, once the requests in flight are queued
+func (l *ingestListener) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+
+	return nil
+}
+
+// ServeHTTP accepts a body of StatsD lines, or a JSON array of metrics with the application/json
+// content type. Valid lines are queued for the workers, and the result of every line is returned.
+func (l *ingestListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ingestMaxBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read body (at most %d bytes): %s", ingestMaxBodySize, err), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var lines []IngestResult
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		lines, err = ingestJSONLines(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse JSON body: %s", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, IngestResult{Line: line})
+			}
+		}
+	}
+
+	response := struct {
+		Accepted int            `json:"accepted"`
+		Rejected int            `json:"rejected"`
+		Results  []IngestResult `json:"results"`
+	}{
+		Results: make([]IngestResult, 0, len(lines)),
+	}
+
+	var packets []*[]byte
+	packet := getPacketBuffer(0)
+
+	for _, result := range lines {
+		line := result.Line
+
+		if result.Error == "" {
+			if err := validateLine(line); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		if result.Error != "" {
+			response.Rejected++
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		if len(*packet) > 0 && len(*packet)+len(line)+1 > UDP_MAX_PACKET_SIZE {
+			packets = append(packets, packet)
+			packet = getPacketBuffer(0)
+		}
+		*packet = append(*packet, line...)
+		*packet = append(*packet, '\n')
+
+		result.Accepted = true
+		response.Accepted++
+		response.Results = append(response.Results, result)
+	}
+
+	if len(*packet) > 0 {
+		packets = append(packets, packet)
+	} else {
+		putPacketBuffer(packet)
+	}
+
+	if err := l.queue(r, packets); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	counterIngestAccepted.Add(int64(response.Accepted))
+	counterIngestRejected.Add(int64(response.Rejected))
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// queue sends packets to the workers, waiting for room in the queue until the request is cancelled
+func (l *ingestListener) queue(r *http.Request, packets []*[]byte) error {
+	l.RLock()
+	defer l.RUnlock()
+
+	for i, packet := range packets {
+		if l.closed {
+			releasePackets(packets[i:])
+			return errors.New("Shutting down, not accepting metrics")
+		}
+
+		select {
+		case workerChannel <- packet:
+		case <-r.Context().Done():
+			releasePackets(packets[i:])
+			return errors.New("Request cancelled while waiting for room in the queue")
+		}
+	}
+
+	return nil
+}
+
+func releasePackets(packets []*[]byte) {
+	for _, packet := range packets {
+		putPacketBuffer(packet)
+	}
+}
+
+// ingestJSONLines formats a JSON array of metrics as StatsD lines, with the error of the metrics
+// that can't be formatted safely. Only a body that isn't a JSON array of metrics is an error.
+func ingestJSONLines(body []byte) ([]IngestResult, error) {
+	var metrics []IngestMetric
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return nil, err
+	}
+
+	lines := make([]IngestResult, 0, len(metrics))
+	for _, metric := range metrics {
+		// a string value is used unquoted, so sets can have string members
+		value := string(metric.Value)
+		var member string
+		if err := json.Unmarshal(metric.Value, &member); err == nil {
+			value = member
+		}
+
+		rate := ""
+		if metric.Rate != 0 {
+			rate = strconv.FormatFloat(metric.Rate, 'f', -1, 64)
+		}
+
+		// the line of a rejected metric is only reported, never queued
+		result := IngestResult{Line: formatLine(metric.Name, value, metric.Type, rate, metric.Tags)}
+		if err := validateJSONMetric(metric, value); err != nil {
+			result.Error = err.Error()
+		}
+
+		lines = append(lines, result)
+	}
+
+	return lines, nil
+}
+
+// validateJSONMetric checks that the fields of a JSON metric can't add fields or lines to
+// the StatsD line they are formatted into
+func validateJSONMetric(metric IngestMetric, value string) error {
+	if metric.Name == "" || strings.ContainsAny(metric.Name, "|:#\r\n") {
+		return fmt.Errorf("invalid name %q, it can't be empty or contain '|', ':', '#' or a newline", metric.Name)
+	}
+
+	switch metric.Type {
+	case "c", "ms", "g", "s", "h", "d":
+	default:
+		return fmt.Errorf("%s: %q", errUnknownMetricType, metric.Type)
+	}
+
+	if strings.ContainsAny(value, "|:#\r\n") {
+		return fmt.Errorf("invalid value %q, it can't contain '|', ':', '#' or a newline", value)
+	}
+
+	// tags are key:value, so only a colon is allowed
+	for _, tag := range metric.Tags {
+		if tag == "" || strings.ContainsAny(tag, "|,#\r\n") {
+			return fmt.Errorf("invalid tag %q, it can't be empty or contain '|', ',', '#' or a newline", tag)
+		}
+	}
+
+	return nil
+}
+
+// validateLine checks that a line is an event, a service check, or metrics of a known type
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("Lines can't contain a newline")
+	}
+
+	if strings.HasPrefix(line, eventPrefix) {
+		_, err := parseEventString(line)
+		return err
+	}
+
+	if strings.HasPrefix(line, serviceCheckPrefix) {
+		_, err := parseServiceCheckString(line)
+		return err
+	}
+
+	metrics, err := parseMetrics(line, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, metric := range metrics {
+		switch metric.metricType {
+		case "c", "ms", "g", "s", "h", "d":
+		default:
+			return fmt.Errorf("%s: %s", errUnknownMetricType, metric.metricType)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIngest(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		accepted    []bool
+		queued      string
+	}{
+		{
+			contentType: "text/plain",
+			body:        "a.b:1|c\n\nbad line\nc.d:2|g|#env:prod\na.b:1|x\n_sc|app|0\n",
+			accepted:    []bool{true, false, true, false, true},
+			queued:      "a.b:1|c\nc.d:2|g|#env:prod\n_sc|app|0\n",
+		},
+		{
+			contentType: "application/json; charset=utf-8",
+			body: `[
+				{"name": "a.b", "type": "c", "value": 1, "rate": 0.5},
+				{"name": "users", "type": "s", "value": "bob", "tags": ["env:prod", "app"]},
+				{"name": "no.value", "type": "g"},
+				{"name": "a.b", "type": "c", "value": 1, "rate": 1.5},
+				{"name": "a.b:5|g", "type": "c", "value": 1},
+				{"name": "c.d", "type": "g", "value": 2}
+			]`,
+			accepted: []bool{true, true, false, false, false, true},
+			queued:   "a.b:1|c|@0.5\nusers:bob|s|#env:prod,app\nc.d:2|g\n",
+		},
+	}
+
+	for _, test := range tests {
+		workerChannel = make(chan *[]byte, 10)
+
+		request := httptest.NewRequest("POST", "/ingest", strings.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		recorder := httptest.NewRecorder()
+		newIngestListener().ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", test.contentType, recorder.Code, recorder.Body)
+		}
+
+		var response struct {
+			Results []IngestResult `json:"results"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		accepted := make([]bool, 0)
+		for _, result := range response.Results {
+			accepted = append(accepted, result.Accepted)
+			if !result.Accepted && result.Error == "" {
+				t.Errorf("%s: expected an error for '%s'", test.contentType, result.Line)
+			}
+		}
+		if !reflect.DeepEqual(accepted, test.accepted) {
+			t.Errorf("%s: expected %v, got %v", test.contentType, test.accepted, accepted)
+		}
+
+		queued := ""
+		for len(workerChannel) > 0 {
+			queued = queued + string(*<-workerChannel)
+		}
+		if queued != test.queued {
+			t.Errorf("%s: expected %q queued, got %q", test.contentType, test.queued, queued)
+		}
+	}
+}
+
+func TestIngestRejected(t *testing.T) {
+	workerChannel = make(chan *[]byte, 10)
+	listener := newIngestListener()
+
+	recorder := httptest.NewRecorder()
+	listener.ServeHTTP(recorder, httptest.NewRequest("GET", "/ingest", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for GET, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/ingest", strings.NewReader("[{"))
+	request.Header.Set("Content-Type", "application/json")
+	listener.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid JSON, got %d", recorder.Code)
+	}
+
+	// fields that would add fields or lines to the StatsD line reject the metric
+	for _, body := range []string{
+		`[{"name": "a.b:5|g", "type": "c", "value": 1}]`,
+		`[{"name": "a\nb", "type": "c", "value": 1}]`,
+		`[{"name": "a.b|#env:prod", "type": "c", "value": 1}]`,
+		`[{"name": "", "type": "c", "value": 1}]`,
+		`[{"name": "users", "type": "s", "value": "bob|c\nx:1"}]`,
+		`[{"name": "a.b", "type": "c", "value": 1, "tags": ["env:prod,role:web"]}]`,
+		`[{"name": "a.b", "type": "c", "value": 1, "tags": ["env:prod|@0.01"]}]`,
+		`[{"name": "a.b", "type": "c", "value": 1, "tags": ["env\nx:1|c"]}]`,
+		`[{"name": "a.b", "type": "c|#admin:true", "value": 1}]`,
+		`[{"name": "a.b", "type": "c:5|g", "value": 1}]`,
+		`[{"name": "a.b", "type": "c|@0.01", "value": 1}]`,
+	} {
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		listener.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", body, recorder.Code)
+			continue
+		}
+
+		var response struct {
+			Accepted int            `json:"accepted"`
+			Rejected int            `json:"rejected"`
+			Results  []IngestResult `json:"results"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Accepted != 0 || response.Rejected != 1 || len(response.Results) != 1 || response.Results[0].Error == "" {
+			t.Errorf("%s: expected the metric to be rejected, got %+v", body, response)
+		}
+	}
+	if n := len(workerChannel); n != 0 {
+		t.Errorf("expected nothing queued for rejected metrics, got %d packets", n)
+	}
+
+	listener.Close()
+
+	recorder = httptest.NewRecorder()
+	listener.ServeHTTP(recorder, httptest.NewRequest("POST", "/ingest", strings.NewReader("a.b:1|c")))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 once closed, got %d", recorder.Code)
+	}
+	if n := len(workerChannel); n != 0 {
+		t.Errorf("expected nothing queued, got %d packets", n)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listener is a source of StatsD packets for the workers
+type Listener interface {
+	// Serve queues packets for the workers until the listener is closed
+	Serve()
+	Close() error
+}
+
+// packetListener reads datagrams from a UDP or unixgram socket, each datagram is a packet
+type packetListener struct {
+	conn net.PacketConn
+	path string // the socket file of a unixgram socket, removed on close
+}
+
+// newListeners opens every configured listener, exiting if any can't be opened.
+// POST /ingest on the HTTP server is always one of them.
+func newListeners(cfg AppConfig) []Listener {
+	listeners := append(newUDPListeners(cfg), ingest)
+
+	if cfg.SocketPath != "" {
+		listener, err := newUnixgramListener(cfg)
+		if err != nil {
+			logger.Fatalf("Error setting up unixgram listener: %s (exiting...)", err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	if cfg.TCPPort > 0 {
+		listener, err := newTCPListener(cfg)
+		if err != nil {
+			logger.Fatalf("Error setting up TCP listener: %s (exiting...)", err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
+// newUDPListeners binds the configured number of UDP sockets to the StatsD port, the kernel
+// spreads the packets between them
+func newUDPListeners(cfg AppConfig) []Listener {
+	logger.Infof("Starting %d StatsD UDP listener(s) on %s and port %d", cfg.Readers, cfg.Host, cfg.Port)
+
+	listenConfig := net.ListenConfig{}
+	if cfg.Readers > 1 {
+		listenConfig.Control = reusePort
+	}
+
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	listeners := make([]Listener, 0, cfg.Readers)
+
+	for i := 0; i < cfg.Readers; i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			logger.Fatalf("Error setting up UDP listener: %s (exiting...)", err)
+		}
+
+		if cfg.ReceiveBuffer > 0 {
+			if err := conn.(*net.UDPConn).SetReadBuffer(cfg.ReceiveBuffer); err != nil {
+				logger.Fatalf("Error setting the UDP receive buffer: %s (exiting...)", err)
+			}
+		}
+
+		listeners = append(listeners, &packetListener{conn: conn})
+	}
+
+	return listeners
+}
+
+// newUnixgramListener binds a unix datagram socket at the configured path, replacing a stale
+// socket left behind by a previous run, but not one another process is still listening on
+func newUnixgramListener(cfg AppConfig) (Listener, error) {
+	logger.Infof("Starting StatsD unixgram listener on %s", cfg.SocketPath)
+
+	if info, err := os.Lstat(cfg.SocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", cfg.SocketPath)
+		}
+
+		// only a socket nobody listens on anymore refuses connections
+		conn, err := net.Dial("unixgram", cfg.SocketPath)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", cfg.SocketPath)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("Could not check if %s is in use: %s", cfg.SocketPath, err)
+		}
+
+		if err := os.Remove(cfg.SocketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: cfg.SocketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &packetListener{conn: conn, path: cfg.SocketPath}
+
+	mode, _ := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err := os.Chmod(cfg.SocketPath, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if cfg.ReceiveBuffer > 0 {
+		if err := conn.SetReadBuffer(cfg.ReceiveBuffer); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// Serve reads packets into the worker queue until the listener is closed
+func (l *packetListener) Serve() {
+	defer listenersDone.Done()
+
+	buf := make([]byte, UDP_MAX_PACKET_SIZE)
+
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				return
+			}
+
+			logger.Errorf("Error READ: %s\n", err.Error())
+			continue
+		}
+
+		queuePacket(buf[:n])
+	}
+}
+
+func (l *packetListener) Close() error {
+	err := l.conn.Close()
+
+	if l.path != "" {
+		os.Remove(l.path)
+	}
+
+	return err
+}
+
+// queuePacket copies a packet into a pooled buffer for the workers, or drops it if the queue is full
+func queuePacket(data []byte) {
+	packet := getPacketBuffer(len(data))
+	copy(*packet, data)
+
+	select {
+	case workerChannel <- packet:
+	default:
+		putPacketBuffer(packet)
+
+		statsLock.RLock()
+		counterOverflow.Add(1)
+		statsLock.RUnlock()
+		logger.Error("StatsD message queue is full, dropping message")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixgramListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-rewrite-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.SocketPath = filepath.Join(dir, "dsd.socket")
+	cfg.SocketMode = "0660"
+
+	// a stale socket from a previous run is replaced
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: cfg.SocketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+
+	workerChannel = make(chan *[]byte, 1)
+	listener, err := newUnixgramListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(cfg.SocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("expected mode 0660, got %o", info.Mode().Perm())
+	}
+
+	listenersDone.Add(1)
+	go listener.Serve()
+
+	client, err := net.Dial("unixgram", cfg.SocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("a.b:1|c")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case packet := <-workerChannel:
+		if string(*packet) != "a.b:1|c" {
+			t.Errorf("expected packet 'a.b:1|c', got '%s'", *packet)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a packet")
+	}
+
+	listener.Close()
+	listenersDone.Wait()
+
+	if _, err := os.Stat(cfg.SocketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestUnixgramListenerNotASocket(t *testing.T) {
+	f, err := ioutil.TempFile("", "statsd-rewrite-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg := defaultConfig()
+	cfg.SocketPath = f.Name()
+
+	if _, err := newUnixgramListener(cfg); err == nil {
+		t.Error("expected an error for a path that isn't a socket")
+	}
+}
+
+func TestUnixgramListenerInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-rewrite-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig()
+	cfg.SocketPath = filepath.Join(dir, "dsd.socket")
+
+	// another proxy still listens on the socket
+	other, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: cfg.SocketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if _, err := newUnixgramListener(cfg); err == nil {
+		t.Error("expected an error for a socket in use")
+	}
+	if _, err := os.Stat(cfg.SocketPath); err != nil {
+		t.Errorf("expected the socket in use to be kept, got %v", err)
+	}
+}
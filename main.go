@@ -2,17 +2,16 @@ package main
 
 import (
 	"errors"
-	"net"
+	"flag"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
 	"strings"
-
-	"time"
+	"sync"
+	"syscall"
 
 	"fmt"
 
-	datadog "github.com/DataDog/datadog-go/statsd"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,83 +21,92 @@ const (
 	UDP_MAX_PACKET_SIZE int = 64 * 1024
 )
 
-// AppConfig ...
-type AppConfig struct {
-	Host string
-	Port int
-}
-
 // StatsDMetric ...
 type StatsDMetric struct {
 	name       string
 	metricType string
 	floatvalue float64
-	intvalue   int64
 	strvalue   string
+	rawvalue   string // the value exactly as received
 	samplerate float64
+	rawrate    string // the sample rate exactly as received, empty if there was none
+	tags       []string
+	delta      bool // a gauge given as +N or -N, relative to its current value
 }
 
 var (
-	logger         = logrus.New()
-	listenPortHTTP = getHTTPListenPort()
-	workerChannel  = make(chan []byte, 10000)
-	quitChannel    = make(chan string)
-	rules          = &Rules{}
-	noTags         = make([]string, 0) // pre-computed empty tags for fallthrough metrics
+	logger        = logrus.New()
+	config        AppConfig
+	workerChannel chan *[]byte   // packets, in buffers from packetPool
+	listenersDone sync.WaitGroup // producers writing to workerChannel
+	workersDone   sync.WaitGroup // consumers reading from workerChannel
+	workersStop   chan struct{}  // closed to stop the workers before the queue is drained
 
 	debug bool
-
-	counterProcessed int64
-	counterRewritten int64
-	counterRelayed   int64
-	counterOverflow  int64
-	counterDropped   int64
-	countersPassed   int64
-	countersMissed   int64
 )
 
 func main() {
-	if os.Getenv("DEBUG") != "" {
+	if len(os.Args) > 1 && os.Args[1] == "test-rules" {
+		os.Exit(testRules(os.Args[2:]))
+	}
+
+	cfg, printOnly, err := loadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logger.Fatalf("Invalid configuration: %s", err)
+	}
+
+	if printOnly {
+		printConfig(cfg)
+		return
+	}
+
+	config = cfg
+
+	if config.Debug {
 		logger.Level = logrus.DebugLevel
 		debug = true
 	}
 
-	dataDogClient, err := datadog.NewBuffered("127.0.0.1:8125", 10)
+	if err := reloadRules("startup"); err != nil {
+		logger.Fatalf("Could not load rules: %s", err)
+	}
+
+	go watchReloadSignal()
+	if config.RulesWatch > 0 && config.RulesFile != "" {
+		go watchRulesFile(config.RulesFile, config.RulesWatch)
+	}
+
+	emitter, err := NewEmitter(config)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	cfg := AppConfig{"0.0.0.0", 8126}
-
-	createRules()
+	workerChannel = make(chan *[]byte, config.QueueSize)
+	workersStop = make(chan struct{})
 
 	go startHTTPServer()
-	go listenUDP(cfg)
 	go printStats()
 
-	workerCount := runtime.NumCPU()
-	for x := 0; x < workerCount; x++ {
-		go work(dataDogClient, x)
+	listeners := newListeners(config)
+	listenersDone.Add(len(listeners))
+	for _, listener := range listeners {
+		go listener.Serve()
 	}
 
-	<-quitChannel
-}
-
-func printStats() {
-	ticker := time.NewTicker(1 * time.Minute)
-	for {
-		logger.Infof("Processed %s | Rewritten: %s | Relayed: %s | Dropped: %s | Passed: %s | Skipped: %s | Overflow: %s, Queued: %s",
-			formatNumber(counterProcessed),
-			formatNumber(counterRewritten),
-			formatNumber(counterRelayed),
-			formatNumber(counterDropped),
-			formatNumber(countersPassed),
-			formatNumber(countersMissed),
-			formatNumber(counterOverflow),
-			formatNumber(int64(len(workerChannel))),
-		)
-		<-ticker.C
+	workersDone.Add(config.Workers)
+	for x := 0; x < config.Workers; x++ {
+		go work(emitter, x)
 	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	logger.Infof("Received %s, shutting down", sig)
+	shutdown(listeners, emitter)
 }
 
 func formatNumber(n int64) string {
@@ -120,268 +128,372 @@ func formatNumber(n int64) string {
 	}
 }
 
-func listenUDP(cfg AppConfig) {
-	logger.Infof("Starting StatsD UDP listener on %s and port %d", cfg.Host, cfg.Port)
-	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cfg.Host), Port: cfg.Port})
-	if err != nil {
-		logger.Fatalf("Error setting up UDP listener: %s (exiting...)", err)
-	}
+func work(emitter *Emitter, workerID int) {
+	logger.Infof("[%d] Starting worker", workerID)
 
-	defer listener.Close()
+	defer workersDone.Done()
 
-	buf := make([]byte, UDP_MAX_PACKET_SIZE)
+	// reused for the metrics of every line, so parsing doesn't allocate
+	metrics := make([]StatsDMetric, 0, 8)
 
 	for {
-		n, _, err := listener.ReadFromUDP(buf)
-		if err != nil && !strings.Contains(err.Error(), "closed network") {
-			logger.Errorf("Error READ: %s\n", err.Error())
-			continue
+		// once stopped, don't start another packet even if more are queued
+		select {
+		case <-workersStop:
+			return
+		default:
 		}
 
-		bufCopy := make([]byte, n)
-		copy(bufCopy, buf[:n])
-
+		var packet *[]byte
 		select {
-		case workerChannel <- bufCopy:
-		default:
-			counterOverflow = counterOverflow + 1
-			logger.Error("StatsD message queue is full, dropping message")
+		case <-workersStop:
+			return
+		case p, ok := <-workerChannel:
+			if !ok {
+				return
+			}
+			packet = p
 		}
+
+		// pin the rule set for the whole packet, so a reload can't swap it mid-way
+		metrics = processPacket(emitter, currentRules(), *packet, workerID, metrics)
+
+		// nothing refers to the buffer once the packet is processed
+		putPacketBuffer(packet)
+		counterPackets.Add(1)
 	}
 }
 
-func work(dataDogClient *datadog.Client, workerID int) {
-	logger.Infof("[%d] Starting worker", workerID)
+// processPacket runs every line of a packet through the rules, and forwards the results
+func processPacket(emitter *Emitter, ruleSet *Rules, data []byte, workerID int, metrics []StatsDMetric) []StatsDMetric {
+	// the only copy of the packet, every line and field is a substring of it, as the packet buffer is reused
+	packet := string(data)
+	for len(packet) > 0 {
+		line := packet
+		if end := strings.IndexByte(packet, '\n'); end >= 0 {
+			line, packet = packet[:end], packet[end+1:]
+		} else {
+			packet = ""
+		}
 
-	for {
-		select {
-		case <-quitChannel:
-			return
-		case data := <-workerChannel:
-			lines := strings.Split(string(data), "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
 
-				if line == "" {
-					continue
-				}
+		metrics = processLine(emitter, ruleSet, line, workerID, metrics)
+	}
 
-				metrics, err := parsePacketString(line)
-				if err != nil {
-					logger.Error(err)
-					continue
-				}
+	return metrics
+}
 
-				for _, metric := range metrics {
-
-					counterProcessed = counterProcessed + 1
-
-					relay := false
-					match := false
-
-					// loop our rewrite rules until we find a match
-					for _, rule := range rules.list {
-						// try to match the metric to our rules
-						result := rule.FindStringSubmatchMap(metric.name)
-
-						// If the rule didn't match the metric, keep searching
-						if result.action == ruleActionMiss {
-							continue
-						}
-
-						// If the result action is anything but "miss", we actually matched something!
-						match = true
-
-						// If the rule did match the metric, and it should be ignore, break out
-						if result.action == ruleActionDrop {
-							relay = false
-							counterDropped = counterDropped + 1
-							break
-						}
-
-						// Relay the metric as-is
-						if result.action == ruleActionRelay {
-							relay = true
-							counterRelayed = counterRelayed + 1
-							break
-						}
-
-						// If we get to here, we assume it's a match
-						if result.action != ruleActionMatch {
-							panic(fmt.Sprintf("Unknown result action: %s", result.action))
-						}
-
-						// if no captures, keep searching
-						if len(result.Captures) == 0 {
-							logger.Warningf("Did match '%s' to '%s', but there was 0 capture groups", rule.name, rule.Regexp.String())
-							continue
-						}
-
-						counterRewritten = counterRewritten + 1
-						ruleHitsSuccess.Add(1)
-
-						if debug {
-							logger.Debugf("[%d] Found match for '%s', emitting as '%s'", workerID, metric.name, result.name)
-						}
-
-						switch metric.metricType {
-						case "c":
-							dataDogClient.Count(result.name, metric.intvalue, result.Tags, metric.samplerate)
-						case "ms":
-							dataDogClient.Timing(result.name, time.Duration(metric.floatvalue), result.Tags, metric.samplerate)
-						case "g":
-							dataDogClient.Gauge(result.name, metric.floatvalue, result.Tags, metric.samplerate)
-						case "s":
-							dataDogClient.Set(result.name, metric.strvalue, result.Tags, metric.samplerate)
-						case "h":
-							dataDogClient.Histogram(result.name, metric.floatvalue, result.Tags, metric.samplerate)
-						default:
-							logger.Fatalf("Unknown metric type: %s", metric.metricType)
-						}
-
-						relay = false
-						break
-					}
-
-					if !relay {
-						continue
-					}
-
-					ruleHitsMiss.Add(1)
-
-					if !match {
-						logger.Warnf("[%d] No match found for '%s', relaying unmodified", workerID, metric.name)
-						countersMissed = countersMissed + 1
-					} else if debug {
-						logger.Debugf("[%d] relaying '%s' unmodified", workerID, metric.name)
-					}
-
-					switch metric.metricType {
-					case "c":
-						dataDogClient.Count(metric.name, metric.intvalue, noTags, metric.samplerate)
-					case "ms":
-						dataDogClient.Timing(metric.name, time.Duration(metric.floatvalue), noTags, metric.samplerate)
-					case "g":
-						dataDogClient.Gauge(metric.name, metric.floatvalue, noTags, metric.samplerate)
-					case "s":
-						dataDogClient.Set(metric.name, metric.strvalue, noTags, metric.samplerate)
-					case "h":
-						dataDogClient.Histogram(metric.name, metric.floatvalue, noTags, metric.samplerate)
-					default:
-						logger.Fatalf("Unknown metric type: %s", metric.metricType)
-					}
-				}
+// processLine runs a single line of a packet through the rules, and forwards the result.
+// It returns the metrics storage, which may have grown, to be reused for the next line.
+func processLine(emitter *Emitter, ruleSet *Rules, line string, workerID int, metrics []StatsDMetric) []StatsDMetric {
+	if isEventOrServiceCheck(line) {
+		if err := processEventOrServiceCheck(emitter, ruleSet, line, workerID); err != nil {
+			logger.Error(err)
+			recordPacketError(packetErrorParseFailure, err, line)
+		}
+		return metrics
+	}
+
+	metrics, err := parseMetrics(line, metrics)
+	if err != nil {
+		logger.Error(err)
+		recordPacketError(packetErrorParseFailure, err, line)
+		return metrics
+	}
+
+	// every metric on a line has the same name, so they all get the same result
+	name := metrics[0].name
+	count := int64(len(metrics))
+
+	_, result := ruleSet.Resolve(name)
+
+	// the rule may send its output to only some of the upstreams
+	emitter = emitter.route(result.destination)
+
+	switch result.action {
+	case ruleActionDrop:
+		// If the rule did match the metric, and it should be ignore, skip it
+		countMetrics(count, counterDropped)
+		return metrics
+
+	case ruleActionNoCapture:
+		// Only rules without capture groups matched, so there is nothing to rewrite
+		countMetrics(count, nil)
+		return metrics
+
+	case ruleActionRelay:
+		// Relay the metric as-is
+		countMetrics(count, counterRelayed)
+
+	case ruleActionMiss:
+		countMetrics(count, countersMissed)
+
+		if !config.RelayUnmatched {
+			// No rule matched, so there is nothing to emit
+			if debug {
+				logger.Debugf("[%d] No match found for '%s', dropping it", workerID, name)
+			}
+			return metrics
+		}
+
+		logger.Warnf("[%d] No match found for '%s', relaying unmodified", workerID, name)
+
+	case ruleActionMatch:
+		countMetrics(count, counterRewritten)
+		ruleHitsSuccess.Add(count)
+
+		if debug {
+			logger.Debugf("[%d] Found match for '%s', emitting as '%s'", workerID, name, result.name)
+		}
+
+		for i := range metrics {
+			metric := &metrics[i]
+			tags := mergeTags(metric.tags, result.Tags, config.TagConflict)
+
+			if err := emitter.Metric(result.name, metric, tags); err != nil {
+				emitFailed(workerID, metric, line, err)
 			}
 		}
+		return metrics
+
+	default:
+		countMetrics(count, nil)
+		err := fmt.Errorf("Unknown result action: %s", result.action)
+		logger.Errorf("[%d] %s, skipping '%s'", workerID, err, name)
+		recordPacketError(packetErrorUnknownAction, err, line)
+		return metrics
+	}
+
+	ruleHitsMiss.Add(count)
+
+	if debug {
+		logger.Debugf("[%d] relaying '%s' unmodified", workerID, name)
 	}
+
+	// relayed lines are forwarded exactly as received, rather than re-encoded
+	if err := emitter.Raw(name, metrics[0].tags, line); err != nil {
+		emitFailed(workerID, &metrics[0], line, err)
+	}
+
+	return metrics
 }
 
+// emitFailed logs a metric that couldn't be forwarded, and records it if its type is unknown
+func emitFailed(workerID int, metric *StatsDMetric, line string, err error) {
+	if err == errUnknownMetricType {
+		err = fmt.Errorf("%s: %s", err, metric.metricType)
+		recordPacketError(packetErrorUnknownType, err, line)
+	}
+
+	logger.Errorf("[%d] Could not forward '%s': %s", workerID, metric.name, err)
+}
+
+// parsePacketString parses a StatsD line into newly allocated metrics
 func parsePacketString(line string) ([]*StatsDMetric, error) {
-	res := make([]*StatsDMetric, 0)
+	metrics, err := parseMetrics(line, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*StatsDMetric, len(metrics))
+	for i := range metrics {
+		res[i] = &metrics[i]
+	}
+
+	return res, nil
+}
+
+// parseMetrics parses a StatsD line into metrics, reusing the storage of the given metrics (and
+// their tags) so a worker doesn't allocate per line. The metrics reference the line, and are
+// only valid until the next call with the same storage. A line can hold several values for the
+// same name, e.g. "a:1|c:2|c|@0.5" is [1 c] and [2 c @0.5]. DogStatsD tag sections may contain
+// ":", so they never start a new value.
+func parseMetrics(line string, metrics []StatsDMetric) ([]StatsDMetric, error) {
+	metrics = metrics[:0]
 
 	// Validate splitting the line on ":"
-	bits := strings.Split(line, ":")
-	if len(bits) < 2 {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
 		logger.Errorf("Error: splitting ':', Unable to parse metric: %s\n", line)
-		return nil, errors.New("Error Parsing statsd line")
+		return metrics, errors.New("Error Parsing statsd line")
 	}
 
 	// Extract bucket name from individual metric bits
-	bucketName, bits := bits[0], bits[1:]
-
-	// Add a metric for each bit available
-	for _, bit := range bits {
-		m := StatsDMetric{}
-
-		m.name = bucketName
-
-		// Validate splitting the bit on "|"
-		pipesplit := strings.Split(bit, "|")
-		if len(pipesplit) < 2 {
-			logger.Errorf("Splitting '|', Unable to parse metric: %s\n", line)
-			return nil, errors.New("Error Parsing statsd line")
-		} else if len(pipesplit) > 2 {
-			sr := pipesplit[2]
-			errmsg := "Parsing sample rate, %s, it must be in format like: @0.1, @0.5, etc. Ignoring sample rate for line: %s\n"
-
-			if strings.Contains(sr, "@") && len(sr) > 1 {
-				samplerate, err := strconv.ParseFloat(sr[1:], 64)
-
-				if err != nil {
-					logger.Errorf(errmsg, err.Error(), line)
-				} else {
-					// sample rate successfully parsed
-					m.samplerate = samplerate
+	name := line[:colon]
+	rest := line[colon+1:]
+
+	metrics, m := nextMetric(metrics, name)
+	field := 0
+
+	for i := 0; ; i++ {
+		section := rest
+		end := strings.IndexByte(rest, '|')
+		if end >= 0 {
+			section, rest = rest[:end], rest[end+1:]
+		}
+
+		if i > 0 && strings.HasPrefix(section, "#") {
+			setMetricField(m, field, section, line)
+			field = field + 1
+		} else {
+			for {
+				part := section
+				next := strings.IndexByte(section, ':')
+				if next >= 0 {
+					part, section = section[:next], section[next+1:]
 				}
-			} else {
-				logger.Errorf(errmsg, "", line)
+
+				setMetricField(m, field, part, line)
+				field = field + 1
+
+				if next < 0 {
+					break
+				}
+
+				// a ":" starts the next value
+				if err := finishMetric(m, field, line); err != nil {
+					return metrics[:0], err
+				}
+
+				metrics, m = nextMetric(metrics, name)
+				field = 0
 			}
 		}
 
-		if m.samplerate == 0 {
-			m.samplerate = 1
+		if end < 0 {
+			break
 		}
+	}
 
-		// Validate metric type
-		switch pipesplit[1] {
-		case "gf":
-			m.metricType = "g"
-		case "g", "c", "s", "ms", "h":
-			m.metricType = pipesplit[1]
-		default:
-			logger.Printf("E! Error: Statsd Metric type %s unsupported", pipesplit[1])
-			return nil, errors.New("Error Parsing statsd line")
-		}
+	if err := finishMetric(m, field, line); err != nil {
+		return metrics[:0], err
+	}
 
-		// Parse the value
-		if strings.HasPrefix(pipesplit[0], "-") || strings.HasPrefix(pipesplit[0], "+") {
-			if m.metricType != "g" && m.metricType != "c" {
-				logger.Printf("E! Error: +- values are only supported for gauges & counters: %s\n", line)
-				return nil, errors.New("Error Parsing statsd line")
-			}
+	return metrics, nil
+}
+
+// nextMetric appends a metric to metrics, reusing the storage beyond its length
+func nextMetric(metrics []StatsDMetric, name string) ([]StatsDMetric, *StatsDMetric) {
+	if len(metrics) < cap(metrics) {
+		metrics = metrics[:len(metrics)+1]
+	} else {
+		metrics = append(metrics, StatsDMetric{})
+	}
+
+	m := &metrics[len(metrics)-1]
+	*m = StatsDMetric{name: name, tags: m.tags[:0]}
+
+	return metrics, m
+}
+
+// setMetricField sets the value, the type, or one of the sections after them
+func setMetricField(m *StatsDMetric, field int, section string, line string) {
+	switch field {
+	case 0:
+		m.rawvalue = section
+		return
+	case 1:
+		m.metricType = section
+		return
+	}
+
+	// The sample rate and DogStatsD tags can come in any order after the type
+	if strings.HasPrefix(section, "#") {
+		m.tags = appendTags(m.tags, section[1:])
+		return
+	}
+
+	errmsg := "Parsing sample rate, %s, it must be in format like: @0.1, @0.5, etc. Ignoring sample rate for line: %s\n"
+
+	if strings.HasPrefix(section, "@") && len(section) > 1 {
+		samplerate, err := strconv.ParseFloat(section[1:], 64)
+
+		if err != nil {
+			logger.Errorf(errmsg, err.Error(), line)
+		} else {
+			// sample rate successfully parsed
+			m.samplerate = samplerate
+			m.rawrate = section[1:]
 		}
+	} else {
+		logger.Errorf(errmsg, "", line)
+	}
+}
 
-		switch m.metricType {
-		case "g", "ms", "h":
-			v, err := strconv.ParseFloat(pipesplit[0], 64)
-			if err != nil {
-				logger.Errorf("Error: parsing value to float64: %s\n", line)
-				return nil, errors.New("Error Parsing statsd line")
-			}
-			m.floatvalue = v
-		case "c":
-			var v int64
-			v, err := strconv.ParseInt(pipesplit[0], 10, 64)
-			if err != nil {
-				v2, err2 := strconv.ParseFloat(pipesplit[0], 64)
-				if err2 != nil {
-					logger.Errorf("Error: parsing value to int64: %s\n", line)
-					return nil, errors.New("Error Parsing statsd line")
-				}
-				v = int64(v2)
-			}
+// finishMetric validates a metric once all its fields are set, and parses its value
+func finishMetric(m *StatsDMetric, fields int, line string) error {
+	// Validate the bit has at least a value and a type
+	if fields < 2 {
+		logger.Errorf("Splitting '|', Unable to parse metric: %s\n", line)
+		return errors.New("Error Parsing statsd line")
+	}
 
-			// If a sample rate is given with a counter, divide value by the rate
-			if m.samplerate != 0 && m.metricType == "c" {
-				v = int64(float64(v) / m.samplerate)
-			}
+	// the sample rate is the fraction of the values the client sent, anything else can't be scaled
+	if m.rawrate != "" && !(m.samplerate > 0 && m.samplerate <= 1) {
+		logger.Errorf("Error: sample rate must be more than 0 and at most 1: %s\n", line)
+		return fmt.Errorf("Error Parsing statsd line, invalid sample rate @%s", m.rawrate)
+	}
+
+	if m.samplerate == 0 {
+		m.samplerate = 1
+	}
+
+	// Validate metric type
+	switch m.metricType {
+	case "gf":
+		m.metricType = "g"
+	case "g", "c", "s", "ms", "h", "d":
+	default:
+		logger.Printf("E! Error: Statsd Metric type %s unsupported", m.metricType)
+		return errors.New("Error Parsing statsd line")
+	}
 
-			m.intvalue = v
-		case "s":
-			m.strvalue = pipesplit[0]
+	// Parse the value
+	if strings.HasPrefix(m.rawvalue, "-") || strings.HasPrefix(m.rawvalue, "+") {
+		if m.metricType != "g" && m.metricType != "c" {
+			logger.Printf("E! Error: +- values are only supported for gauges & counters: %s\n", line)
+			return errors.New("Error Parsing statsd line")
 		}
 
-		res = append(res, &m)
+		// a signed gauge value changes the gauge rather than setting it
+		m.delta = m.metricType == "g"
 	}
 
-	return res, nil
+	switch m.metricType {
+	case "g", "c", "ms", "h", "d":
+		// counters are kept as sent, they are only scaled by the sample rate when forwarded
+		v, err := strconv.ParseFloat(m.rawvalue, 64)
+		if err != nil {
+			logger.Errorf("Error: parsing value to float64: %s\n", line)
+			return errors.New("Error Parsing statsd line")
+		}
+		m.floatvalue = v
+	case "s":
+		m.strvalue = m.rawvalue
+	}
+
+	return nil
 }
 
-func getHTTPListenPort() string {
-	port := os.Getenv("NOMAD_PORT_http")
-	if port == "" {
-		port = "4200"
+// appendTags appends the tags in a DogStatsD tag section (without the leading "#") to tags
+func appendTags(tags []string, section string) []string {
+	for len(section) > 0 {
+		tag := section
+		comma := strings.IndexByte(section, ',')
+		if comma >= 0 {
+			tag, section = section[:comma], section[comma+1:]
+		} else {
+			section = ""
+		}
+
+		if tag != "" {
+			tags = append(tags, tag)
+		}
 	}
 
-	return port
+	return tags
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.Out = ioutil.Discard
+	config = defaultConfig()
+	os.Exit(m.Run())
+}
+
+func TestParsePacketString(t *testing.T) {
+	tests := []struct {
+		line    string
+		metrics []StatsDMetric
+		err     bool
+	}{
+		{line: "a.b:1|c", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1}}},
+		{line: "a.b:1.9|c", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1.9, rawvalue: "1.9", samplerate: 1}}},
+		{line: "a.b:1|c|@0.5", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 0.5, rawrate: "0.5"}}},
+		{line: "a.b:1|c|@.10", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 0.1, rawrate: ".10"}}},
+		{line: "a.b:1|c|0.5", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1}}},
+		{line: "a.b:1|c|@x", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1}}},
+		{line: "a.b:-3|c", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: -3, rawvalue: "-3", samplerate: 1}}},
+		{line: "a.b:12.5|g", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: 12.5, rawvalue: "12.5", samplerate: 1}}},
+		{line: "a.b:12.5|gf", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: 12.5, rawvalue: "12.5", samplerate: 1}}},
+		{line: "a.b:+2|g", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: 2, rawvalue: "+2", samplerate: 1, delta: true}}},
+		{line: "a.b:-2.5|g", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: -2.5, rawvalue: "-2.5", samplerate: 1, delta: true}}},
+		{line: "a.b:+0|g", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: 0, rawvalue: "+0", samplerate: 1, delta: true}}},
+		{line: "a.b:0|g", metrics: []StatsDMetric{{name: "a.b", metricType: "g", floatvalue: 0, rawvalue: "0", samplerate: 1}}},
+		{line: "a.b:320|ms|@0.1", metrics: []StatsDMetric{{name: "a.b", metricType: "ms", floatvalue: 320, rawvalue: "320", samplerate: 0.1, rawrate: "0.1"}}},
+		{line: "a.b:7|h", metrics: []StatsDMetric{{name: "a.b", metricType: "h", floatvalue: 7, rawvalue: "7", samplerate: 1}}},
+		{line: "a.b:0.25|d|@0.5", metrics: []StatsDMetric{{name: "a.b", metricType: "d", floatvalue: 0.25, rawvalue: "0.25", samplerate: 0.5, rawrate: "0.5"}}},
+		{line: "a.b:user-1|s", metrics: []StatsDMetric{{name: "a.b", metricType: "s", strvalue: "user-1", rawvalue: "user-1", samplerate: 1}}},
+		{line: "a.b:1|c:2.5|g", metrics: []StatsDMetric{
+			{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1},
+			{name: "a.b", metricType: "g", floatvalue: 2.5, rawvalue: "2.5", samplerate: 1},
+		}},
+		{line: "a.b:1|c|#env:prod,role", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1, tags: []string{"env:prod", "role"}}}},
+		{line: "a.b:1|c|#env:prod|@0.5", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 0.5, rawrate: "0.5", tags: []string{"env:prod"}}}},
+		{line: "a.b:1|c|@0.5|#env:prod", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 0.5, rawrate: "0.5", tags: []string{"env:prod"}}}},
+		{line: "a.b:1|c|#env:prod:2|c", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1, tags: []string{"env:prod:2"}}}},
+		{line: "a.b:1|c|@0.5:2|g|#env:prod", metrics: []StatsDMetric{
+			{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 0.5, rawrate: "0.5"},
+			{name: "a.b", metricType: "g", floatvalue: 2, rawvalue: "2", samplerate: 1, tags: []string{"env:prod"}},
+		}},
+		{line: "a.b", err: true},
+		{line: "a.b:1", err: true},
+		{line: "a.b:1|x", err: true},
+		{line: "a.b:x|g", err: true},
+		{line: "a.b:x|c", err: true},
+		{line: "a.b:-1|ms", err: true},
+		{line: "a.b:-1|d", err: true},
+		{line: "a.b:1|c:2", err: true},
+		// sample rates are in (0, 1]
+		{line: "a.b:1|c|@1", metrics: []StatsDMetric{{name: "a.b", metricType: "c", floatvalue: 1, rawvalue: "1", samplerate: 1, rawrate: "1"}}},
+		{line: "a.b:1|c|@0", err: true},
+		{line: "a.b:1|c|@-0.5", err: true},
+		{line: "a.b:1|c|@1.5", err: true},
+		{line: "a.b:1|g|@NaN", err: true},
+	}
+
+	for _, test := range tests {
+		metrics, err := parsePacketString(test.line)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.line)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.line, err)
+			continue
+		}
+
+		if len(metrics) != len(test.metrics) {
+			t.Errorf("%s: expected %d metrics, got %d", test.line, len(test.metrics), len(metrics))
+			continue
+		}
+
+		for i, metric := range metrics {
+			if !reflect.DeepEqual(*metric, test.metrics[i]) {
+				t.Errorf("%s: expected metric %+v, got %+v", test.line, test.metrics[i], *metric)
+			}
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := map[int64]string{
+		0:          "0",
+		7:          "7",
+		999:        "999",
+		1000:       "1,000",
+		123456:     "123,456",
+		1234567:    "1,234,567",
+		-1:         "-1",
+		-100:       "-100",
+		-1000:      "-1,000",
+		-123456789: "-123,456,789",
+	}
+
+	for n, expected := range tests {
+		if actual := formatNumber(n); actual != expected {
+			t.Errorf("formatNumber(%d): expected %s, got %s", n, expected, actual)
+		}
+	}
+}
+
+func TestProcessLine(t *testing.T) {
+	ruleSet, err := parseRules([]byte(`
+rules:
+  - { pattern: "app.{service}.requests", action: match, name: "app.requests" }
+  - { pattern: "app.*", action: relay }
+  - { pattern: "debug.*", action: drop }
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(relay bool) { config.RelayUnmatched = relay }(config.RelayUnmatched)
+
+	tests := []struct {
+		line           string
+		relayUnmatched bool
+		counterMode    string
+		expected       []string
+	}{
+		// relayed and unmatched lines are forwarded byte for byte
+		{line: "app.runtime.heap:1.50|g|#env:prod", expected: []string{"app.runtime.heap:1.50|g|#env:prod"}},
+		{line: "app.runtime.gc:12.5|ms|@0.1", expected: []string{"app.runtime.gc:12.5|ms|@0.1"}},
+		{line: "other.metric:1|c:2|c|@0.5", relayUnmatched: true, expected: []string{"other.metric:1|c:2|c|@0.5"}},
+		// unmatched lines are dropped unless relay_unmatched is set
+		{line: "other.metric:1|c:2|c|@0.5", expected: nil},
+		{line: "app.web.requests:1|c:2|c", expected: []string{"app.requests:1|c|#service:web\napp.requests:2|c|#service:web"}},
+		{line: "app.web.requests:12.5|ms|@0.5", expected: []string{"app.requests:12.5|ms|@0.5|#service:web"}},
+		{line: "debug.metric:1|c", expected: nil},
+		{line: "not a metric", expected: nil},
+		{line: "app.web.requests:1|c|@0", expected: nil},
+		// only rewritten counters are prescaled, relayed and unmatched ones keep their sample rate
+		{line: "app.web.requests:1|c|@0.5", counterMode: counterModePrescale, expected: []string{"app.requests:2|c|#service:web"}},
+		{line: "app.runtime.allocs:1|c|@0.1", counterMode: counterModePrescale, expected: []string{"app.runtime.allocs:1|c|@0.1"}},
+		{line: "other.metric:1|c|@0.5", relayUnmatched: true, counterMode: counterModePrescale, expected: []string{"other.metric:1|c|@0.5"}},
+	}
+
+	for _, test := range tests {
+		config.RelayUnmatched = test.relayUnmatched
+
+		emitter, recorders := newTestEmitter(t, 10)
+		recorder := recorders[0]
+		if test.counterMode != "" {
+			emitter.counterMode = test.counterMode
+		}
+
+		processLine(emitter, ruleSet, test.line, 0, nil)
+		emitter.Close()
+
+		if !reflect.DeepEqual(recorder.packets, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.line, test.expected, recorder.packets)
+		}
+	}
+}
+
+func TestProcessLineRouting(t *testing.T) {
+	ruleSet, err := parseRules([]byte(`
+rules:
+  - { pattern: "nomad.allocation.{alloc}.cpu", action: match, name: "nomad.allocation.cpu", upstreams: [datadog] }
+  - { pattern: "vault.*", action: relay, upstreams: [aggregator] }
+  - { pattern: "consul.*", action: relay, upstreams: [aggregator, datadog] }
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(relay bool) { config.RelayUnmatched = relay }(config.RelayUnmatched)
+	config.RelayUnmatched = true
+
+	tests := []struct {
+		line       string
+		datadog    []string
+		aggregator []string
+	}{
+		{line: "nomad.allocation.abc.cpu:5|g", datadog: []string{"nomad.allocation.cpu:5|g|#alloc:abc"}},
+		{line: "vault.core.unseal:1|c", aggregator: []string{"vault.core.unseal:1|c"}},
+		{line: "consul.raft.apply:1|c", datadog: []string{"consul.raft.apply:1|c"}, aggregator: []string{"consul.raft.apply:1|c"}},
+		// unmatched metrics go to every upstream, when they are relayed
+		{line: "other.metric:1|c", datadog: []string{"other.metric:1|c"}, aggregator: []string{"other.metric:1|c"}},
+	}
+
+	for _, test := range tests {
+		emitter, recorders := newTestEmitter(t, 10, "datadog", "aggregator")
+		datadog, aggregator := recorders[0], recorders[1]
+
+		processLine(emitter, ruleSet, test.line, 0, nil)
+		emitter.Close()
+
+		if !reflect.DeepEqual(datadog.packets, test.datadog) {
+			t.Errorf("%s: expected %q sent to datadog, got %q", test.line, test.datadog, datadog.packets)
+		}
+		if !reflect.DeepEqual(aggregator.packets, test.aggregator) {
+			t.Errorf("%s: expected %q sent to aggregator, got %q", test.line, test.aggregator, aggregator.packets)
+		}
+	}
+}
+
+func TestParseMetricsReusesStorage(t *testing.T) {
+	metrics := make([]StatsDMetric, 0, 1)
+
+	metrics, err := parseMetrics("a.b:2|g|@0.5:1|c|#env:prod,role:web", metrics)
+	if err != nil || len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d (%v)", len(metrics), err)
+	}
+
+	// nothing from the previous line may leak into the next one
+	metrics, err = parseMetrics("c.d:user-1|s", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StatsDMetric{{name: "c.d", metricType: "s", strvalue: "user-1", rawvalue: "user-1", samplerate: 1}}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metrics)
+	}
+
+	if metrics, err = parseMetrics("c.d:x|g", metrics); err == nil || len(metrics) != 0 {
+		t.Errorf("expected an error and no metrics, got %d (%v)", len(metrics), err)
+	}
+}
+
+// benchPacket is a typical packet from a Nomad client, with a few application metrics
+var benchPacket = []byte(strings.Join([]string{
+	"nomad.client.allocs.example.cache.1234abcd-1234-abcd-1234-1234abcd1234.redis.memory.rss:1048576|g",
+	"nomad.client.allocs.example.cache.1234abcd-1234-abcd-1234-1234abcd1234.redis.cpu.total_percent:12.5|g",
+	"nomad.runtime.num_goroutines:120|g",
+	"nomad.raft.apply:1|c|@0.5",
+	"app.request.latency:12.5|ms|@0.1|#env:prod,role:web",
+	"app.requests:1|c:2|c|#env:prod",
+}, "\n"))
+
+func BenchmarkParseMetrics(b *testing.B) {
+	metrics := make([]StatsDMetric, 0, 8)
+	lines := strings.Split(string(benchPacket), "\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchPacket)))
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			metrics, _ = parseMetrics(line, metrics)
+		}
+	}
+}
+
+func BenchmarkProcessPacket(b *testing.B) {
+	ruleSet, err := loadRules("")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	emitter, _ := newTestEmitter(b, 1000000)
+	metrics := make([]StatsDMetric, 0, 8)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchPacket)))
+	for i := 0; i < b.N; i++ {
+		metrics = processPacket(emitter, ruleSet, benchPacket, 0, metrics)
+	}
+}
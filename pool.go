@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"sync"
+)
+
+// minPacketBufferSize is the smallest buffer allocated for a packet, so most packets fit in any pooled buffer
+const minPacketBufferSize = 1500
+
+// packetPool recycles the buffers packets are queued in, from the listeners to the workers and back
+var packetPool sync.Pool
+
+var (
+	counterBuffersAllocated = newCounter("packet_buffers_allocated")
+	counterBuffersReused    = newCounter("packet_buffers_reused")
+)
+
+func init() {
+	statNames = append(statNames, "heap_alloc_bytes")
+	expvar.Publish("heap_alloc_bytes", expvar.Func(func() interface{} {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}))
+}
+
+// getPacketBuffer returns a buffer of length n, reusing a pooled buffer if it's large enough
+func getPacketBuffer(n int) *[]byte {
+	if buf, ok := packetPool.Get().(*[]byte); ok && cap(*buf) >= n {
+		counterBuffersReused.Add(1)
+		*buf = (*buf)[:n]
+		return buf
+	}
+
+	counterBuffersAllocated.Add(1)
+
+	size := n
+	if size < minPacketBufferSize {
+		size = minPacketBufferSize
+	}
+
+	buf := make([]byte, n, size)
+	return &buf
+}
+
+// putPacketBuffer returns a buffer to the pool, it must not be used afterwards
+func putPacketBuffer(buf *[]byte) {
+	packetPool.Put(buf)
+}
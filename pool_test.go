@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetPacketBuffer(t *testing.T) {
+	for _, n := range []int{0, 10, minPacketBufferSize, 4000, 20, UDP_MAX_PACKET_SIZE, 30} {
+		buf := getPacketBuffer(n)
+
+		if len(*buf) != n {
+			t.Errorf("expected a buffer of length %d, got %d", n, len(*buf))
+		}
+
+		if cap(*buf) < minPacketBufferSize {
+			t.Errorf("expected a buffer of at least %d bytes, got %d", minPacketBufferSize, cap(*buf))
+		}
+
+		putPacketBuffer(buf)
+	}
+}
+
+// BenchmarkReceivePacket is the path of a packet from the listener to a worker, without processing it
+func BenchmarkReceivePacket(b *testing.B) {
+	queue := make(chan *[]byte, 1)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchPacket)))
+	for i := 0; i < b.N; i++ {
+		packet := getPacketBuffer(len(benchPacket))
+		copy(*packet, benchPacket)
+
+		queue <- packet
+		putPacketBuffer(<-queue)
+	}
+}
@@ -5,14 +5,29 @@ import "strings"
 
 import "fmt"
 
-func buildRegexp(rule string) *regexp.Regexp {
+func buildRegexp(rule string) (*regexp.Regexp, error) {
 	regRule := make([]string, 0)
+	captures := make(map[string]bool)
 
 	chunks := strings.Split(rule, ".")
 	for _, chunk := range chunks {
+		if chunk == "" {
+			return nil, fmt.Errorf("empty segment in pattern")
+		}
+
 		// if the chunk contains markers, make it into a pattern match
 		if chunk[:1] == "{" {
-			chunk = fmt.Sprintf(`(?P<%s>[^\.]+)`, chunk[1:len(chunk)-1])
+			if chunk[len(chunk)-1:] != "}" || len(chunk) < 3 {
+				return nil, fmt.Errorf("invalid capture '%s', must be in format like: {name}", chunk)
+			}
+
+			name := chunk[1 : len(chunk)-1]
+			if captures[name] {
+				return nil, fmt.Errorf("duplicate capture '%s'", chunk)
+			}
+			captures[name] = true
+
+			chunk = fmt.Sprintf(`(?P<%s>[^\.]+)`, name)
 		} else if chunk[:1] == "*" { // Stars will just glob anything
 			chunk = `.+?`
 		} else { // litterals will be, well, litterals and just escape for safe regexp processing
@@ -24,5 +39,5 @@ func buildRegexp(rule string) *regexp.Regexp {
 
 	reg := strings.Join(regRule, `\.+`)
 	logger.Debugf("Pattern: %s", reg)
-	return regexp.MustCompile(reg)
+	return regexp.Compile(reg)
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildRegexp(t *testing.T) {
+	tests := []struct {
+		rule    string
+		pattern string
+		err     string
+	}{
+		{rule: "nomad.uptime", pattern: `nomad\.+uptime`},
+		{rule: "nomad.*", pattern: `nomad\.+.+?`},
+		{rule: "nomad.client.uptime.{nomad_client}", pattern: `nomad\.+client\.+uptime\.+(?P<nomad_client>[^\.]+)`},
+		{rule: "fabio.{fabio_service}.*.count", pattern: `fabio\.+(?P<fabio_service>[^\.]+)\.+.+?\.+count`},
+		{rule: "app+1.(x)", pattern: `app\+1\.+\(x\)`},
+		{rule: "nomad..uptime", err: "empty segment"},
+		{rule: "nomad.{client", err: "invalid capture"},
+		{rule: "nomad.{}", err: "invalid capture"},
+		{rule: "nomad.{a}.{a}", err: "duplicate capture"},
+		{rule: "nomad.{a-b}", err: "invalid named capture"},
+	}
+
+	for _, test := range tests {
+		reg, err := buildRegexp(test.rule)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing '%s', got %v", test.rule, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.rule, err)
+			continue
+		}
+
+		if reg.String() != test.pattern {
+			t.Errorf("%s: expected pattern %s, got %s", test.rule, test.pattern, reg.String())
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReloadStatus describes the outcome of the latest attempt to (re)load the rules
+type ReloadStatus struct {
+	Generation int64     `json:"generation"`
+	Rules      int       `json:"rules"`
+	Source     string    `json:"source"`
+	Reason     string    `json:"reason"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+var (
+	activeRules  atomic.Value // *Rules currently used by the workers
+	reloadLock   sync.Mutex   // serializes reloads and guards reloadStatus
+	reloadStatus ReloadStatus
+)
+
+// currentRules returns the active rule set, safe to call from any goroutine
+func currentRules() *Rules {
+	return activeRules.Load().(*Rules)
+}
+
+// reloadRules builds a fresh rule set from the rules file and swaps it in,
+// keeping the active rules if the new set fails to load
+func reloadRules(reason string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	status := ReloadStatus{
+		Generation: reloadStatus.Generation,
+		Rules:      reloadStatus.Rules,
+		Source:     rulesSource(config.RulesFile),
+		Reason:     reason,
+		Time:       time.Now(),
+	}
+
+	newRules, err := loadRules(config.RulesFile)
+	if err == nil {
+		err = newRules.checkUpstreams(config.upstreams())
+	}
+	if err != nil {
+		status.Error = err.Error()
+		reloadStatus = status
+
+		logger.Errorf("Rules reload (%s) failed, keeping generation %d with %d rules: %s", reason, status.Generation, status.Rules, err)
+		return err
+	}
+
+	status.Generation = status.Generation + 1
+	status.Rules = len(newRules.list)
+	status.Success = true
+	reloadStatus = status
+
+	newRules.generation = status.Generation
+	activeRules.Store(newRules)
+
+	logger.Infof("Rules reload (%s) succeeded, loaded generation %d with %d rules from %s", reason, status.Generation, status.Rules, status.Source)
+	return nil
+}
+
+// watchReloadSignal reloads the rules every time the process receives SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadRules("SIGHUP")
+	}
+}
+
+// watchRulesFile polls the rules file and reloads the rules when it changes
+func watchRulesFile(path string, interval time.Duration) {
+	logger.Infof("Watching %s for changes every %s", path, interval)
+
+	lastModTime, lastSize := statRulesFile(path)
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		modTime, size := statRulesFile(path)
+		if modTime.Equal(lastModTime) && size == lastSize {
+			continue
+		}
+
+		lastModTime, lastSize = modTime, size
+		reloadRules("file change")
+	}
+}
+
+func statRulesFile(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+
+	return info.ModTime(), info.Size()
+}
+
+// showReloadStatus reports the latest reload outcome, and reloads the rules on POST
+func showReloadStatus(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	if r.Method == http.MethodPost {
+		if err := reloadRules("HTTP"); err != nil {
+			code = http.StatusInternalServerError
+		}
+	}
+
+	reloadLock.Lock()
+	status := reloadStatus
+	reloadLock.Unlock()
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadRules(t *testing.T) {
+	defer func(path string) { config.RulesFile = path }(config.RulesFile)
+	config.RulesFile = filepath.Join(t.TempDir(), "rules.yaml")
+
+	writeRules := func(rules string) {
+		if err := ioutil.WriteFile(config.RulesFile, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeRules(`rules: [{pattern: "a.*", action: relay}]`)
+	if err := reloadRules("test"); err != nil {
+		t.Fatal(err)
+	}
+	active := currentRules()
+	generation := active.generation
+
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{name: "invalid yaml", rules: `rules: [{pattern: "a.*"`, err: "Could not parse rules"},
+		{name: "invalid rule", rules: `rules: [{pattern: "a.*", action: rewrite}]`, err: "unknown action"},
+		{name: "unknown upstream", rules: `rules: [{pattern: "a.*", action: relay, upstreams: [sink]}]`, err: "sink"},
+	}
+
+	for _, test := range tests {
+		writeRules(test.rules)
+
+		err := reloadRules("test")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.name, test.err, err)
+		}
+
+		// the active rules are kept as they were
+		if currentRules() != active || currentRules().generation != generation {
+			t.Errorf("%s: expected generation %d to stay active, got %d", test.name, generation, currentRules().generation)
+		}
+		if reloadStatus.Success || reloadStatus.Generation != generation || reloadStatus.Error == "" {
+			t.Errorf("%s: expected a failed reload of generation %d, got %+v", test.name, generation, reloadStatus)
+		}
+	}
+
+	writeRules(`rules: [{pattern: "a.*", action: relay}, {pattern: "b.*", action: drop}]`)
+	if err := reloadRules("test"); err != nil {
+		t.Fatal(err)
+	}
+	if actual := currentRules().generation; actual != generation+1 {
+		t.Errorf("expected generation %d, got %d", generation+1, actual)
+	}
+	if len(currentRules().list) != 2 || !reloadStatus.Success || reloadStatus.Rules != 2 {
+		t.Errorf("expected the 2 new rules to be active, got %+v", reloadStatus)
+	}
+}
+
+func TestShowReloadStatus(t *testing.T) {
+	defer func(path string) { config.RulesFile = path }(config.RulesFile)
+	config.RulesFile = filepath.Join(t.TempDir(), "rules.yaml")
+
+	requests := []struct {
+		method  string
+		rules   string
+		code    int
+		success bool
+		offset  int64 // from the generation before the requests
+	}{
+		{method: "POST", rules: `rules: [{pattern: "a.*", action: relay}]`, code: http.StatusOK, success: true, offset: 1},
+		{method: "GET", code: http.StatusOK, success: true, offset: 1},
+		{method: "POST", rules: `rules: []`, code: http.StatusInternalServerError, offset: 1},
+		{method: "GET", code: http.StatusOK, offset: 1},
+		{method: "POST", rules: `rules: [{pattern: "b.*", action: drop}]`, code: http.StatusOK, success: true, offset: 2},
+	}
+
+	reloadLock.Lock()
+	generation := reloadStatus.Generation
+	reloadLock.Unlock()
+
+	for i, request := range requests {
+		if request.rules != "" {
+			if err := ioutil.WriteFile(config.RulesFile, []byte(request.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		showReloadStatus(recorder, httptest.NewRequest(request.method, "/rules/reload", nil))
+
+		if recorder.Code != request.code {
+			t.Errorf("#%d %s: expected status %d, got %d", i, request.method, request.code, recorder.Code)
+		}
+
+		var status ReloadStatus
+		if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Success != request.success || status.Reason != "HTTP" || status.Generation != generation+request.offset {
+			t.Errorf("#%d %s: expected success %t of generation %d, got %+v", i, request.method, request.success, generation+request.offset, status)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ringReplicas is how many points each backend has on the hash ring, more points spread the
+// metrics more evenly
+const ringReplicas = 160
+
+// healthCheckTimeout is the longest a health check waits for a connection
+const healthCheckTimeout = 2 * time.Second
+
+// hashRing is a consistent-hash ring of backends. A key belongs to the first backend clockwise from
+// its hash, so adding or removing a backend only moves the keys of that backend.
+type hashRing struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend int // index in the list of addresses the ring was built from
+}
+
+// newHashRing places every address on the ring, the points only depend on the address,
+// so they don't move when other backends are added or removed
+func newHashRing(addresses []string) *hashRing {
+	ring := &hashRing{points: make([]ringPoint, 0, len(addresses)*ringReplicas)}
+
+	for i, address := range addresses {
+		for replica := 0; replica < ringReplicas; replica++ {
+			sum := md5.Sum([]byte(address + "-" + strconv.Itoa(replica)))
+			ring.points = append(ring.points, ringPoint{hash: binary.BigEndian.Uint32(sum[:4]), backend: i})
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+
+	return ring
+}
+
+// get returns the backend for key, skipping the backends that aren't healthy. If none are healthy,
+// the key goes to the backend it would have with all of them up.
+func (r *hashRing) get(key string, healthy func(backend int) bool) int {
+	hash := hashKey(key)
+
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	for i := 0; i < len(r.points); i++ {
+		point := r.points[(start+i)%len(r.points)]
+		if healthy(point.backend) {
+			return point.backend
+		}
+	}
+
+	return r.points[start%len(r.points)].backend
+}
+
+// hashKey is the 32-bit FNV-1a hash of key, with its bits spread so similar metric names land
+// far apart on the ring
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
+
+// checkHealth checks the backends with a health check address at every interval, until the
+// upstream is closed. A backend is up when a TCP connection to its health check address succeeds.
+func (u *upstream) checkHealth(interval time.Duration) {
+	checked := false
+	for _, b := range u.backends {
+		checked = checked || b.healthCheck != ""
+	}
+	if !checked || interval <= 0 {
+		return
+	}
+
+	timeout := healthCheckTimeout
+	if interval < timeout {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range u.backends {
+			if b.healthCheck != "" {
+				u.checkBackend(b, timeout)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// checkBackend updates whether a backend is up, logging when that changes
+func (u *upstream) checkBackend(b *backend, timeout time.Duration) {
+	conn, err := net.DialTimeout("tcp", b.healthCheck, timeout)
+	if err == nil {
+		conn.Close()
+
+		if atomic.SwapInt32(&b.healthy, 1) == 0 {
+			logger.Infof("Upstream %s: backend %s is back up, adding it to the ring", u.name, b.address)
+		}
+		return
+	}
+
+	if atomic.SwapInt32(&b.healthy, 0) == 1 {
+		logger.Warnf("Upstream %s: backend %s is down, removing it from the ring: %s", u.name, b.address, err)
+	}
+}
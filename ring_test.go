@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func allHealthy(int) bool {
+	return true
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	ring := newHashRing([]string{"10.0.0.1:8125", "10.0.0.2:8125", "10.0.0.3:8125"})
+
+	counts := make([]int, 3)
+	for i := 0; i < 30000; i++ {
+		counts[ring.get("app.requests."+strconv.Itoa(i), allHealthy)]++
+	}
+
+	for backend, count := range counts {
+		if count < 7000 || count > 13000 {
+			t.Errorf("expected backend %d to get about a third of the keys, got %d of 30000", backend, count)
+		}
+	}
+}
+
+func TestHashRingRemoval(t *testing.T) {
+	addresses := []string{"10.0.0.1:8125", "10.0.0.2:8125", "10.0.0.3:8125", "10.0.0.4:8125"}
+	ring := newHashRing(addresses)
+
+	// without 10.0.0.2, either because it's down or because it left the pool
+	withoutDown := func(backend int) bool { return backend != 1 }
+	smaller := newHashRing([]string{addresses[0], addresses[2], addresses[3]})
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := "app.requests." + strconv.Itoa(i)
+		before := addresses[ring.get(key, allHealthy)]
+		down := addresses[ring.get(key, withoutDown)]
+		after := []string{addresses[0], addresses[2], addresses[3]}[smaller.get(key, allHealthy)]
+
+		if down != after {
+			t.Fatalf("%s: expected a down backend to be the same as a removed one, got %s and %s", key, down, after)
+		}
+
+		if before == addresses[1] {
+			moved++
+			continue
+		}
+
+		// only the keys of the removed backend move
+		if after != before {
+			t.Fatalf("%s: expected to stay on %s, moved to %s", key, before, after)
+		}
+	}
+
+	if moved == 0 {
+		t.Error("expected some keys to move off the removed backend")
+	}
+}
+
+func TestHashRingNoneHealthy(t *testing.T) {
+	ring := newHashRing([]string{"10.0.0.1:8125", "10.0.0.2:8125"})
+
+	expected := ring.get("app.requests", allHealthy)
+	if got := ring.get("app.requests", func(int) bool { return false }); got != expected {
+		t.Errorf("expected backend %d when none are healthy, got %d", expected, got)
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	// a local stand-in for the health check of the first backend, the second one refuses connections
+	standIn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standIn.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	recorders := []*packetRecorder{{}, {}}
+	u := &upstream{name: "pool", stop: make(chan struct{})}
+	for i, healthCheck := range []string{standIn.Addr().String(), closed.Addr().String()} {
+		b, err := newBackend("10.0.0."+strconv.Itoa(i+1)+":8125", newPacketBuffer(recorders[i], 1, 1432))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.healthCheck = healthCheck
+		u.backends = append(u.backends, b)
+	}
+	u.ring = newHashRing(u.addresses())
+
+	for _, b := range u.backends {
+		u.checkBackend(b, healthCheckTimeout)
+	}
+
+	if healthy := atomic.LoadInt32(&u.backends[0].healthy); healthy != 1 {
+		t.Error("expected the first backend to be up")
+	}
+	if healthy := atomic.LoadInt32(&u.backends[1].healthy); healthy != 0 {
+		t.Error("expected the second backend to be down")
+	}
+
+	emitter := &Emitter{upstreams: []*upstream{u}, counterMode: counterModeFaithful}
+	for i := 0; i < 20; i++ {
+		emitter.Raw("app.requests."+strconv.Itoa(i), nil, "app.requests."+strconv.Itoa(i)+":1|c")
+	}
+	emitter.Close()
+
+	if len(recorders[0].packets) != 20 || len(recorders[1].packets) != 0 {
+		t.Errorf("expected every metric on the first backend, got %d and %d", len(recorders[0].packets), len(recorders[1].packets))
+	}
+}
+
+func TestUpstreamPick(t *testing.T) {
+	u := &upstream{name: "pool", stop: make(chan struct{})}
+	for i := 0; i < 3; i++ {
+		b, err := newBackend("10.0.0."+strconv.Itoa(i+1)+":8125", newPacketBuffer(&packetRecorder{}, 1, 1432))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.backends = append(u.backends, b)
+	}
+	u.ring = newHashRing(u.addresses())
+
+	// the order of the tags doesn't matter
+	u.hashTags = true
+	if u.pick("app.requests", []string{"a:1", "b:2"}) != u.pick("app.requests", []string{"b:2", "a:1"}) {
+		t.Error("expected the same backend for the same tags in another order")
+	}
+
+	// without hash_tags, every series of a metric goes to the same backend
+	u.hashTags = false
+	expected := u.pick("app.requests", nil)
+	for i := 0; i < 20; i++ {
+		if u.pick("app.requests", []string{"host:" + strconv.Itoa(i)}) != expected {
+			t.Fatal("expected the same backend for every tag without hash_tags")
+		}
+	}
+}
@@ -1,79 +1,174 @@
 package main
 
 import (
+	"bytes"
+	_ "embed" // default rules file
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
-	ruleActionMatch = "match"
-	ruleActionDrop  = "drop"
-	ruleActionRelay = "relay"
-	ruleActionMiss  = "miss"
+	ruleActionMatch     = "match"
+	ruleActionDrop      = "drop"
+	ruleActionRelay     = "relay"
+	ruleActionMiss      = "miss"
+	ruleActionNoCapture = "no_capture" // only "match" rules without any captures matched
 )
 
+// markerRegexp finds the {capture} markers in a rewritten metric name
+var markerRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// defaultRules are used when no rules file is configured
+//
+//go:embed rules.yaml
+var defaultRules []byte
+
 // Rule ...
 type Rule struct {
+	stats ruleCounters // first, so the counters are 64-bit aligned for sync/atomic
+
 	*regexp.Regexp
-	name   string
-	action string
+	pattern     string
+	name        string
+	action      string
+	destination string // the upstreams the rule's output goes to, see routeKey
 }
 
 // RuleResult ...
 type RuleResult struct {
-	Captures map[string]string
-	Tags     []string
-	name     string
-	action   string
+	Captures    map[string]string
+	Tags        []string
+	name        string
+	action      string
+	destination string
 }
 
 // Rules ...
 type Rules struct {
-	list []*Rule
+	list       []*Rule
+	generation int64
 }
 
-func (r *Rules) Match(ruleString, newPath string) {
-	r.list = append(r.list, NewMatchRule(ruleString, newPath))
+// RuleConfig is a single rule entry in a rules file
+type RuleConfig struct {
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Action  string `yaml:"action" json:"action"`
+	Name    string `yaml:"name,omitempty" json:"name,omitempty"`
+
+	// Upstreams the rule's output goes to, every upstream when empty
+	Upstreams []string `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
 }
 
-func (r *Rules) Relay(ruleString string) {
-	r.list = append(r.list, NewRelayRule(ruleString))
+// RulesConfig is the on-disk format of a rules file
+type RulesConfig struct {
+	Rules []RuleConfig `yaml:"rules" json:"rules"`
+}
+
+// Add compiles and appends a new rule to the end of the rule list
+func (r *Rules) Add(cfg RuleConfig) error {
+	rule, err := NewRule(cfg)
+	if err != nil {
+		return err
+	}
+
+	r.list = append(r.list, rule)
+	return nil
 }
 
-func (r *Rules) Drop(ruleString string) {
-	r.list = append(r.list, NewDropRule(ruleString))
+// NewRule validates and compiles a rule from its config
+func NewRule(cfg RuleConfig) (*Rule, error) {
+	switch cfg.Action {
+	case ruleActionMatch:
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("rule '%s' has action '%s' but no name to rewrite to", cfg.Pattern, cfg.Action)
+		}
+	case ruleActionDrop, ruleActionRelay:
+		if cfg.Name != "" {
+			return nil, fmt.Errorf("rule '%s' has action '%s', which can't have a name", cfg.Pattern, cfg.Action)
+		}
+		if cfg.Action == ruleActionDrop && len(cfg.Upstreams) > 0 {
+			return nil, fmt.Errorf("rule '%s' has action '%s', which can't have upstreams", cfg.Pattern, cfg.Action)
+		}
+	default:
+		return nil, fmt.Errorf("rule '%s' has unknown action '%s'", cfg.Pattern, cfg.Action)
+	}
+
+	for _, upstream := range cfg.Upstreams {
+		if upstream == "" || strings.Contains(upstream, ",") {
+			return nil, fmt.Errorf("rule '%s' has an invalid upstream name '%s'", cfg.Pattern, upstream)
+		}
+	}
+
+	reg, err := buildRegexp(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule '%s' has an invalid pattern: %s", cfg.Pattern, err)
+	}
+
+	rule := &Rule{
+		Regexp:      reg,
+		pattern:     cfg.Pattern,
+		action:      cfg.Action,
+		name:        cfg.Name,
+		destination: routeKey(cfg.Upstreams),
+	}
+
+	// every {marker} in the new name must be captured by the pattern
+	for _, marker := range markerRegexp.FindAllStringSubmatch(cfg.Name, -1) {
+		if !rule.hasCapture(marker[1]) {
+			return nil, fmt.Errorf("rule '%s' uses '%s' in its name, but the pattern has no such capture", cfg.Pattern, marker[0])
+		}
+	}
+
+	return rule, nil
 }
 
-// NewMatchRule ...
-func NewMatchRule(ruleString string, newPath string) *Rule {
-	return &Rule{
-		action: ruleActionMatch,
-		Regexp: buildRegexp(ruleString),
-		name:   newPath,
+// routeKey is the sorted, comma-separated list of upstream names, empty for every upstream
+func routeKey(upstreams []string) string {
+	names := make([]string, 0, len(upstreams))
+	seen := make(map[string]bool, len(upstreams))
+	for _, name := range upstreams {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
 }
 
-// NewDropRule ..
-func NewDropRule(ruleString string) *Rule {
-	return &Rule{
-		action: ruleActionDrop,
-		Regexp: buildRegexp(ruleString),
+// upstreams returns the names of the upstreams the rule's output goes to, nil for every upstream
+func (r *Rule) upstreams() []string {
+	if r.destination == "" {
+		return nil
 	}
+
+	return strings.Split(r.destination, ",")
 }
 
-// NewRelayRule ...
-func NewRelayRule(rulestring string) *Rule {
-	return &Rule{
-		action: ruleActionRelay,
-		Regexp: buildRegexp(rulestring),
+func (r *Rule) hasCapture(name string) bool {
+	for _, subexp := range r.SubexpNames() {
+		if subexp == name {
+			return true
+		}
 	}
+
+	return false
 }
 
 // FindStringSubmatchMap add a new method to our new regular expression type
 func (r *Rule) FindStringSubmatchMap(s string) *RuleResult {
 	result := &RuleResult{
-		action: r.action,
+		action:      r.action,
+		destination: r.destination,
 	}
 
 	match := r.FindStringSubmatch(s)
@@ -102,186 +197,127 @@ func (r *Rule) FindStringSubmatchMap(s string) *RuleResult {
 	return result
 }
 
-func createRules() {
-
-	/*********************************************************************************************************************************************************
-	 * Vault Metrics
-	 *********************************************************************************************************************************************************/
-
-	// internal metrics
-	rules.Match("vault.runtime.{vault_runtime_type}", "vault.runtime")
-	rules.Match("vault.audit.{vault_audit_type}", "vault.audit")
-	rules.Match("vault.barrier.{vault_barrier_type}", "vault.barrier")
-	rules.Match("vault.consul.{vault_consul_type}", "vault.consul")
-	rules.Match("vault.core.{vault_core_type}", "vault.core")
-
-	// policy and token metrics
-	rules.Match("vault.expire.{vault_expire_type}", "vault.expire")
-	rules.Match("vault.policy.{vault_policy_type}", "vault.policy")
-	rules.Match("vault.token.{vault_token_type}", "vault.token")
-
-	// authentication
-	rules.Match("vault.rollback.attempt.{vault_auth_backend}", "vault.authentication.attempt")
-	rules.Match("vault.route.read.{vault_auth_backend}", "vault.authentication.read")
-	rules.Match("vault.route.renew.{vault_auth_backend}", "vault.authentication.renew")
-	rules.Match("vault.route.revoke.{vault_auth_backend}", "vault.authentication.revoke")
-	rules.Match("vault.route.rollback.{vault_auth_backend}", "vault.authentication.rollback")
-	rules.Match("vault.route.update.{vault_auth_backend}", "vault.authentication.update")
-
-	// storage backends
-	rules.Match("vault.azure.{vault_storage_action}", "vault.storage.azure")
-	rules.Match("vault.dynamodb.{vault_storage_action}", "vault.storage.storage")
-	rules.Match("vault.etcd.{vault_storage_action}", "vault.storage.etcd")
-	rules.Match("vault.gcs.{vault_storage_action}", "vault.storage.gcs")
-	rules.Match("vault.mysql.{vault_storage_action}", "vault.storage.mysql")
-	rules.Match("vault.postgres.{vault_storage_action}", "vault.storage.postgres")
-	rules.Match("vault.s3.{vault_storage_action}", "vault.storage.s3")
-	rules.Match("vault.swift.{vault_storage_action}", "vault.storage.swift")
-	rules.Match("vault.zookeeper.{vault_storage_action}", "vault.storage.zookeeper")
-
-	// Drop anything we didn't match
-	rules.Relay("vault.*")
+// Resolve runs a metric name through the rules in order, and returns the index of the
+// rule that decided the metric (-1 if no rule matched) along with its result
+func (r *Rules) Resolve(metricName string) (int, *RuleResult) {
+	started := time.Now()
+	noCapture := -1
 
-	/*********************************************************************************************************************************************************
-	 * Nomad Key Metrics
-	 *********************************************************************************************************************************************************/
-
-	// nomad.runtime.*
-	rules.Relay("nomad.runtime.*")
-
-	// nomad.raft.*
-	rules.Relay("nomad.raft.*")
-
-	// nomad.broker.*
-	rules.Relay("nomad.broker.*")
-
-	// nomad.plan.*
-	rules.Relay("nomad.plan.*")
-
-	// nomad.uptime
-	rules.Relay("nomad.uptime")
-
-	// nomad.worker.wait_for_index
-	rules.Relay("nomad.worker.wait_for_index")
-
-	// nomad.worker.invoke_scheduler.<type>
-	rules.Match("nomad.worker.invoke_scheduler.{nomad_scheduler}", "nomad.worker.invoke_scheduler")
-
-	// nomad.heartbeat.*
-	rules.Relay("nomad.heartbeat.*")
-
-	// nomad.rpc.*
-	rules.Relay("nomad.rpc.*")
-
-	/*********************************************************************************************************************************************************
-	 * Nomad Host Metrics
-	 *********************************************************************************************************************************************************/
-
-	// nomad.client.uptime.<HostID>
-	rules.Match("nomad.client.uptime.{nomad_client}", "nomad.client.uptime")
-
-	// nomad.client.host.cpu.<HostID>.<CPU-Core>.total
-	// nomad.client.host.cpu.<HostID>.<CPU-Core>.user
-	// nomad.client.host.cpu.<HostID>.<CPU-Core>.system
-	// nomad.client.host.cpu.<HostID>.<CPU-Core>.idle
-	rules.Match("nomad.client.host.cpu.{nomad_client}.{nomad_client_cpu_core}.{nomad_cpu_metric}", "nomad.client.cpu.{nomad_cpu_metric}")
+	for i, rule := range r.list {
+		// most rules don't match, and checking that doesn't allocate, unlike building a result
+		if !rule.MatchString(metricName) {
+			continue
+		}
 
-	// nomad.client.host.disk.<HostID>.<Device-Name>.size
-	// nomad.client.host.disk.<HostID>.<Device-Name>.used
-	// nomad.client.host.disk.<HostID>.<Device-Name>.available
-	// nomad.client.host.disk.<HostID>.<Device-Name>.used_percent
-	// nomad.client.host.disk.<HostID>.<Device-Name>.inodes_percent
-	rules.Match("nomad.client.host.disk.{nomad_client}.{nomad_client_device}.{nomad_disk_metric}", "nomad.client.disk.{nomad_disk_metric}")
+		// try to match the metric to our rules
+		result := rule.FindStringSubmatchMap(metricName)
 
-	// nomad.client.host.memory.<HostID>.total
-	// nomad.client.host.memory.<HostID>.available
-	// nomad.client.host.memory.<HostID>.used
-	// nomad.client.host.memory.<HostID>.free
-	rules.Match("nomad.client.host.memory.{nomad_client}.{nomad_client_memory_metric}", "nomad.client.host.memory.{nomad_client_memory_metric}")
+		switch result.action {
+		case ruleActionMiss:
+			// If the rule didn't match the metric, keep searching
+			continue
 
-	// nomad.client.allocated.cpu.<HostID>
-	rules.Match("nomad.client.allocated.cpu.{nomad_client}", "nomad.client.allocated.cpu")
+		case ruleActionDrop, ruleActionRelay:
+			rule.stats.record(result.action, started)
+			return i, result
 
-	// nomad.client.allocated.memory.<HostID>
-	rules.Match("nomad.client.allocated.memory.{nomad_client}", "nomad.client.allocated.memory")
-
-	// nomad.client.allocated.disk.<HostID>
-	rules.Match("nomad.client.allocated.disk.{nomad_client}", "nomad.client.allocated.disk")
-
-	// nomad.client.allocated.iops.<HostID>
-	rules.Match("nomad.client.allocated.iops.{nomad_client}", "nomad.client.allocated.iops")
-
-	// nomad.client.allocated.network.<Device-Name>.<HostID>
-	rules.Match("nomad.client.allocated.network.{nomad_device_name}.{nomad_client}", "nomad.client.allocated.network")
+		case ruleActionMatch:
+			// if no captures, keep searching
+			if len(result.Captures) == 0 {
+				logger.Warningf("Did match '%s' to '%s', but there was 0 capture groups", rule.name, rule.Regexp.String())
+				rule.stats.recordZeroCaptures()
+				noCapture = i
+				continue
+			}
 
-	// nomad.client.unallocated.cpu.<HostID>
-	rules.Match("nomad.client.unallocated.cpu.{nomad_client}", "nomad.client.unallocated.cpu")
-
-	// nomad.client.unallocated.memory.<HostID>
-	rules.Match("nomad.client.unallocated.memory.{nomad_client}", "nomad.client.unallocated.memory")
+			rule.stats.record(result.action, started)
+			return i, result
 
-	// nomad.client.unallocated.disk.<HostID>
-	rules.Match("nomad.client.unallocated.disk.{nomad_client}", "nomad.client.unallocated.disk")
+		default:
+			return i, result
+		}
+	}
 
-	// nomad.client.unallocated.iops.<HostID>
-	rules.Match("nomad.client.unallocated.iops.{nomad_client}", "nomad.client.unallocated.iops")
+	if noCapture >= 0 {
+		return noCapture, &RuleResult{action: ruleActionNoCapture}
+	}
 
-	// nomad.client.unallocated.network.<Device-Name>.<HostID>
-	rules.Match("nomad.client.unallocated.network.{nomad_device_name}.{nomad_client}", "nomad.client.unallocated.network")
+	return -1, &RuleResult{action: ruleActionMiss}
+}
 
-	/*********************************************************************************************************************************************************
-	 * Nomad Allocation Metrics
-	 *********************************************************************************************************************************************************/
+// checkUpstreams fails if a rule sends its output to an upstream that isn't configured
+func (r *Rules) checkUpstreams(upstreams []UpstreamConfig) error {
+	known := make(map[string]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		known[upstream.Name] = true
+	}
 
-	// nomad.client.allocations.migrating.<HostID>
-	rules.Match("nomad.client.allocations.migrating.{nomad_client}", "nomad.client.allocations.migrating")
+	for i, rule := range r.list {
+		for _, name := range rule.upstreams() {
+			if !known[name] {
+				return fmt.Errorf("Invalid rule #%d: rule '%s' sends to unknown upstream '%s'", i+1, rule.pattern, name)
+			}
+		}
+	}
 
-	// nomad.client.allocations.blocked.<HostID>
-	rules.Match("nomad.client.allocations.blocked.{nomad_client}", "nomad.client.allocations.blocked")
+	return nil
+}
 
-	// nomad.client.allocations.pending.<HostID>
-	rules.Match("nomad.client.allocations.pending.{nomad_client}", "nomad.client.allocations.pending")
+// loadRules reads and compiles the rules file at path, or the built-in rules if path is empty
+func loadRules(path string) (*Rules, error) {
+	if path == "" {
+		return parseRules(defaultRules, "yaml")
+	}
 
-	// nomad.client.allocations.running.<HostID>
-	rules.Match("nomad.client.allocations.running.{nomad_client}", "nomad.client.allocations.running")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read rules file: %s", err)
+	}
 
-	// nomad.client.allocations.terminal.<HostID>
-	rules.Match("nomad.client.allocations.terminal.{nomad_client}", "nomad.client.allocations.terminal")
+	format := "yaml"
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		format = "json"
+	}
 
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.rss
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.cache
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.swap
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.max_usage
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.kernel_usage
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.memory.kernel_max_usage
-	rules.Match("nomad.client.allocs.{nomad_job}.{nomad_task_group}.{nomad_allocation_id}.{nomad_task}.memory.{nomad_job_memory_metric}", "nomad.allocation.memory.{nomad_job_memory_metric}")
+	return parseRules(data, format)
+}
 
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.cpu.total_percent
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.cpu.system
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.cpu.user
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.cpu.throttled_time
-	// nomad.client.allocs.<Job>.<TaskGroup>.<AllocID>.<Task>.cpu.total_ticks
-	rules.Match("nomad.client.allocs.{nomad_job}.{nomad_task_group}.{nomad_allocation_id}.{nomad_task}.cpu.{nomad_job_cpu_metric}", "nomad.allocation.cpu.{nomad_job_cpu_metric}")
+// rulesSource describes where rules are loaded from for logging
+func rulesSource(path string) string {
+	if path == "" {
+		return "built-in rules"
+	}
 
-	rules.Drop("nomad.*")
+	return path
+}
 
-	/*********************************************************************************************************************************************************
-	 * Fabio Metrics
-	 *********************************************************************************************************************************************************/
+// parseRules compiles the rules in a YAML or JSON document, failing on the first invalid rule.
+// Unknown keys are errors, so a misspelled option doesn't silently change what a rule does.
+func parseRules(data []byte, format string) (*Rules, error) {
+	config := RulesConfig{}
+
+	var err error
+	if format == "json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	} else {
+		err = yaml.UnmarshalStrict(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rules: %s", err)
+	}
 
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.count", "fabio.requests.count")
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.min", "fabio.requests.min")
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.max", "fabio.requests.max")
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.95_percentile", "fabio.requests.95_percentile")
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.99_percentile", "fabio.requests.99_percentile")
-	rules.Match("fabio.{fabio_service}.*.{fabio_path}.*.999_percentile", "fabio.requests.999_percentile")
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("No rules defined")
+	}
 
-	rules.Match("fabio.http.status.{fabio_response_code}.count", "fabio.http.response_code.count")
-	rules.Match("fabio.http.status.{fabio_response_code}.min", "fabio.http.response_code.min")
-	rules.Match("fabio.http.status.{fabio_response_code}.max", "fabio.http.response_code.max")
-	rules.Match("fabio.http.status.{fabio_response_code}.95_percentile", "fabio.http.response_code.95_percentile")
-	rules.Match("fabio.http.status.{fabio_response_code}.99_percentile", "fabio.http.response_code.99_percentile")
-	rules.Match("fabio.http.status.{fabio_response_code}.999_percentile", "fabio.http.response_code.999_percentile")
+	rules := &Rules{}
+	for i, ruleConfig := range config.Rules {
+		if err := rules.Add(ruleConfig); err != nil {
+			return nil, fmt.Errorf("Invalid rule #%d: %s", i+1, err)
+		}
+	}
 
-	rules.Drop("fabio.*")
+	return rules, nil
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinRules(t *testing.T) {
+	ruleSet, err := loadRules("")
+	if err != nil {
+		t.Fatalf("Could not load the built-in rules: %s", err)
+	}
+
+	paths, err := filepath.Glob("testdata/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("No fixtures found in testdata/: %v", err)
+	}
+
+	for _, path := range paths {
+		fixtures, err := loadRuleFixtures(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, fixture := range fixtures {
+			if fixture.Action == "" || fixture.Tags == nil {
+				t.Errorf("%s: fixture '%s' must have an expected action and tags", path, fixture.Line)
+			}
+
+			for _, problem := range runRuleFixture(ruleSet, fixture, ioutil.Discard) {
+				t.Errorf("%s: %s: %s", path, fixture.Line, problem)
+			}
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		rules  string
+		err    string
+	}{
+		{
+			name:   "valid yaml",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.{b}", action: match, name: "c.{b}"}, {pattern: "a.*", action: relay}, {pattern: "*", action: drop}]`,
+		},
+		{
+			name:   "valid json",
+			format: "json",
+			rules:  `{"rules": [{"pattern": "a.{b}", "action": "match", "name": "c"}]}`,
+		},
+		{
+			name:   "unknown yaml key",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.*", action: relay, upstream: [sink]}]`,
+			err:    "field upstream not found",
+		},
+		{
+			name:   "unknown json key",
+			format: "json",
+			rules:  `{"rules": [{"pattern": "a.*", "action": "relay", "upstream": ["sink"]}]}`,
+			err:    "unknown field \"upstream\"",
+		},
+		{
+			name:   "no rules",
+			format: "yaml",
+			rules:  `rules: []`,
+			err:    "No rules defined",
+		},
+		{
+			name:   "unknown action",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.{b}", action: rewrite, name: "c"}]`,
+			err:    "unknown action 'rewrite'",
+		},
+		{
+			name:   "match without name",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.{b}", action: match}]`,
+			err:    "no name to rewrite to",
+		},
+		{
+			name:   "drop with name",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.*", action: drop, name: "c"}]`,
+			err:    "can't have a name",
+		},
+		{
+			name:   "relay to upstreams",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.*", action: relay, upstreams: [sink, agent]}]`,
+		},
+		{
+			name:   "drop with upstreams",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.*", action: drop, upstreams: [agent]}]`,
+			err:    "can't have upstreams",
+		},
+		{
+			name:   "invalid upstream name",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.*", action: relay, upstreams: ["a,b"]}]`,
+			err:    "invalid upstream name",
+		},
+		{
+			name:   "unknown marker in name",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a.{b}", action: match, name: "c.{d}"}]`,
+			err:    "the pattern has no such capture",
+		},
+		{
+			name:   "invalid pattern",
+			format: "yaml",
+			rules:  `rules: [{pattern: "a", action: relay}, {pattern: "a..b", action: relay}]`,
+			err:    "Invalid rule #2",
+		},
+		{
+			name:   "invalid document",
+			format: "json",
+			rules:  `rules: []`,
+			err:    "Could not parse rules",
+		},
+	}
+
+	for _, test := range tests {
+		rules, err := parseRules([]byte(test.rules), test.format)
+
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			} else if len(rules.list) == 0 {
+				t.Errorf("%s: no rules were loaded", test.name)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestCheckRuleUpstreams(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - { pattern: "a.{b}", action: match, name: "c", upstreams: [agent, sink, agent] }
+  - { pattern: "d.*", action: relay, upstreams: [sink] }
+  - { pattern: "*", action: relay }
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if destination := rules.list[0].destination; destination != "agent,sink" {
+		t.Errorf("expected destination 'agent,sink', got '%s'", destination)
+	}
+
+	upstreams := []UpstreamConfig{{Name: "agent"}, {Name: "sink"}}
+	if err := rules.checkUpstreams(upstreams); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err := rules.checkUpstreams(upstreams[:1]); err == nil || !strings.Contains(err.Error(), "unknown upstream 'sink'") {
+		t.Errorf("expected an unknown upstream error, got %v", err)
+	}
+}
+
+func TestTestRulesConfig(t *testing.T) {
+	defer func(cfg AppConfig) { config = cfg }(config)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	configPath := write("config.yaml", "upstreams: [{name: agent, address: 127.0.0.1:8125}]")
+	fixtures := write("fixtures.yaml", `[{line: "a.b:1|c", action: relay}]`)
+	valid := write("valid.yaml", `rules: [{pattern: "a.*", action: relay, upstreams: [agent]}]`)
+	unknown := write("unknown.yaml", `rules: [{pattern: "a.*", action: relay, upstreams: [sink]}]`)
+
+	// upstreams are checked against the configured ones, like at startup
+	if code := testRules([]string{"-config", configPath, "-rules", valid, "-fixtures", fixtures}); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if code := testRules([]string{"-config", configPath, "-rules", unknown, "-fixtures", fixtures}); code != 2 {
+		t.Errorf("expected exit code 2 for an unknown upstream, got %d", code)
+	}
+	if code := testRules([]string{"-tag-conflict", "neither", "-fixtures", fixtures}); code != 2 {
+		t.Errorf("expected exit code 2 for an invalid configuration, got %d", code)
+	}
+
+	ruleSet, err := parseRules([]byte(`rules: [{pattern: "a.*", action: relay}]`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unmatched metrics are only forwarded with relay_unmatched
+	for _, relay := range []bool{false, true} {
+		config.RelayUnmatched = relay
+
+		var out strings.Builder
+		runRuleFixture(ruleSet, RuleFixture{Line: "other:1|c"}, &out)
+		if dropped := strings.Contains(out.String(), "dropped"); dropped == relay {
+			t.Errorf("relay_unmatched %t: unexpected output %q", relay, out.String())
+		}
+	}
+}
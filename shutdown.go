@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// shutdown stops accepting packets, drains the worker queue within the configured
+// deadline, flushes the emitter and stops the HTTP server
+func shutdown(listeners []Listener, emitter *Emitter) {
+	deadline := time.Now().Add(config.ShutdownTimeout)
+
+	// stop the producers first, so nothing writes to the queue after it's closed
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	listenersDone.Wait()
+
+	logger.Infof("Draining %s queued packets (timeout %s)", formatNumber(int64(len(workerChannel))), config.ShutdownTimeout)
+	flushed, abandoned := drainWorkers(deadline)
+	logger.Infof("Flushed %s packets, abandoned %s packets", formatNumber(flushed), formatNumber(abandoned))
+
+	// the workers are gone, so nothing writes to the emitter once it's closed
+	if err := emitter.Close(); err != nil {
+		logger.Errorf("Could not flush the emitter: %s", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Could not shut down the HTTP server: %s", err)
+	}
+
+	logger.Info("Shutdown complete")
+}
+
+// drainWorkers closes the queue and waits for the workers to process it until the deadline, then
+// stops them after their current packet. It returns how many packets were processed, and how many
+// were left in the queue.
+func drainWorkers(deadline time.Time) (int64, int64) {
+	processed := counterPackets.Value()
+	close(workerChannel)
+
+	drained := make(chan struct{})
+	go func() {
+		workersDone.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		logger.Warn("Timed out waiting for the workers to drain the queue")
+
+		// the packets still queued are abandoned
+		close(workersStop)
+		<-drained
+	}
+
+	// the workers are gone, so the counts are final
+	return counterPackets.Value() - processed, int64(len(workerChannel))
+}
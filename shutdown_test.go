@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingWriter holds every write until it's released
+type blockingWriter struct {
+	packetRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(data []byte) (int, error) {
+	w.writing <- struct{}{}
+	<-w.release
+	return w.packetRecorder.Write(data)
+}
+
+func TestDrainWorkers(t *testing.T) {
+	defer func(rules *Rules) { activeRules.Store(rules) }(currentRules())
+	ruleSet, err := parseRules([]byte(`rules: [{pattern: "*", action: relay}]`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeRules.Store(ruleSet)
+
+	packets := []string{"a:1|c", "b:1|c", "c:1|c", "d:1|c"}
+
+	// every packet is processed before the deadline
+	emitter, recorders := newTestEmitter(t, 1)
+	startWorkers(emitter, packets)
+
+	flushed, abandoned := drainWorkers(time.Now().Add(time.Second))
+	if flushed != 4 || abandoned != 0 {
+		t.Errorf("expected 4 packets flushed and none abandoned, got %d and %d", flushed, abandoned)
+	}
+	if len(recorders[0].packets) != 4 {
+		t.Errorf("expected the 4 packets sent, got %q", recorders[0].packets)
+	}
+
+	// the worker is still sending the first packet at the deadline
+	writer := &blockingWriter{writing: make(chan struct{}, len(packets)), release: make(chan struct{})}
+	u, err := newUpstream("blocking", newPacketBuffer(writer, 1, 1432))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emitter = &Emitter{upstreams: []*upstream{u}, counterMode: counterModeFaithful}
+	startWorkers(emitter, packets)
+
+	<-writer.writing
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(writer.release)
+	}()
+
+	flushed, abandoned = drainWorkers(time.Now().Add(10 * time.Millisecond))
+	if flushed != 1 || abandoned != 3 {
+		t.Errorf("expected 1 packet flushed and 3 abandoned, got %d and %d", flushed, abandoned)
+	}
+	if len(writer.packets) != 1 {
+		t.Errorf("expected only the first packet sent, got %q", writer.packets)
+	}
+}
+
+// startWorkers queues packets for a single worker sending to emitter
+func startWorkers(emitter *Emitter, packets []string) {
+	workerChannel = make(chan *[]byte, len(packets))
+	workersStop = make(chan struct{})
+
+	for _, packet := range packets {
+		buf := getPacketBuffer(0)
+		*buf = append(*buf, packet...)
+		workerChannel <- buf
+	}
+
+	workersDone.Add(1)
+	go work(emitter, 0)
+}
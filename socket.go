@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	statNames = append(statNames, "udp_receive_drops")
+	expvar.Publish("udp_receive_drops", expvar.Func(func() interface{} {
+		drops, err := kernelDrops(config.Port)
+		if err != nil {
+			return nil
+		}
+		return drops
+	}))
+}
+
+// parseProcNetUDP sums the drops of the sockets bound to port, in the format of /proc/net/udp
+func parseProcNetUDP(r io.Reader, port int) (int64, error) {
+	var drops int64
+
+	scanner := bufio.NewScanner(r)
+	for i := 0; scanner.Scan(); i++ {
+		// the first line is the header
+		fields := strings.Fields(scanner.Text())
+		if i == 0 || len(fields) < 13 {
+			continue
+		}
+
+		// local_address is hex encoded, e.g. 0100007F:1FBE for 127.0.0.1:8126
+		local := fields[1]
+		localPort, err := strconv.ParseInt(local[strings.LastIndexByte(local, ':')+1:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid local address '%s': %s", local, err)
+		}
+
+		if int(localPort) != port {
+			continue
+		}
+
+		n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid drops '%s': %s", fields[len(fields)-1], err)
+		}
+
+		drops = drops + n
+	}
+
+	return drops, scanner.Err()
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePort sets SO_REUSEPORT on a socket before it's bound, so several sockets can share the port
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
+
+// kernelDrops returns how many packets the kernel dropped for the UDP sockets bound to port,
+// usually because their receive buffer was full
+func kernelDrops(port int) (int64, error) {
+	var drops int64
+
+	// sockets listening on both IPv4 and IPv6 are only listed in udp6
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := parseProcNetUDP(f, port)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		drops = drops + n
+	}
+
+	return drops, nil
+}
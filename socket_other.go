@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux, set readers to 1")
+}
+
+func kernelDrops(port int) (int64, error) {
+	return 0, errors.New("Kernel drops are only available on Linux")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	f, err := os.Open("testdata/proc_net_udp.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// two sockets share port 8126 (1FBE) with SO_REUSEPORT
+	drops, err := parseProcNetUDP(f, 8126)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drops != 42 {
+		t.Errorf("expected 42 drops, got %d", drops)
+	}
+
+	drops, err = parseProcNetUDP(strings.NewReader("header\n  1: 00000000:1FBE 00000000:0000 07 00000000:00000000 00:00000000 00000000 0 0 1 2 0 many\n"), 8126)
+	if err == nil {
+		t.Errorf("expected an error, got %d drops", drops)
+	}
+}
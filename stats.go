@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statNames are the expvar counters published by the proxy, in registration order
+var statNames []string
+
+var (
+	counterProcessed = newCounter("metrics_processed")
+	counterRewritten = newCounter("metrics_rewritten")
+	counterRelayed   = newCounter("metrics_relayed")
+	counterDropped   = newCounter("metrics_dropped")
+	countersMissed   = newCounter("metrics_missed")
+	counterOverflow  = newCounter("packets_overflow")
+	counterPackets   = newCounter("packets_processed")
+
+	counterEvents        = newCounter("events_processed")
+	counterServiceChecks = newCounter("service_checks_processed")
+	counterEventsDropped = newCounter("events_dropped")
+
+	ruleHitsSuccess = newCounter("rule_hits_success")
+	ruleHitsMiss    = newCounter("rule_hits_miss")
+)
+
+func init() {
+	statNames = append(statNames, "queue_length")
+	expvar.Publish("queue_length", expvar.Func(func() interface{} {
+		return len(workerChannel)
+	}))
+}
+
+// newCounter registers an atomic counter, published through expvar under name
+func newCounter(name string) *expvar.Int {
+	statNames = append(statNames, name)
+	return expvar.NewInt(name)
+}
+
+// statsLock makes snapshots consistent: the counters in a snapshot are only updated while holding
+// it for reading, and a snapshot holds it for writing, so it never sees half of an update
+var statsLock sync.RWMutex
+
+// countMetrics counts processed metrics along with their outcome, which may be nil
+func countMetrics(count int64, outcome *expvar.Int) {
+	statsLock.RLock()
+	defer statsLock.RUnlock()
+
+	counterProcessed.Add(count)
+	if outcome != nil {
+		outcome.Add(count)
+	}
+}
+
+// StatsSnapshot is a consistent copy of the counters, the metrics processed are counted
+// together with what was done with them
+type StatsSnapshot struct {
+	Processed int64
+	Rewritten int64
+	Relayed   int64
+	Dropped   int64
+	Missed    int64
+	Overflow  int64
+	Queued    int64
+
+	KernelDrops int64 // -1 if unavailable
+}
+
+func takeStatsSnapshot() StatsSnapshot {
+	statsLock.Lock()
+	stats := StatsSnapshot{
+		Processed: counterProcessed.Value(),
+		Rewritten: counterRewritten.Value(),
+		Relayed:   counterRelayed.Value(),
+		Dropped:   counterDropped.Value(),
+		Missed:    countersMissed.Value(),
+		Overflow:  counterOverflow.Value(),
+		Queued:    int64(len(workerChannel)),
+
+		KernelDrops: -1,
+	}
+	statsLock.Unlock()
+
+	if drops, err := kernelDrops(config.Port); err == nil {
+		stats.KernelDrops = drops
+	}
+
+	return stats
+}
+
+func printStats() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for {
+		stats := takeStatsSnapshot()
+		logger.Infof("Processed %s | Rewritten: %s | Relayed: %s | Dropped: %s | Skipped: %s | Overflow: %s, Queued: %s, Kernel drops: %s",
+			formatNumber(stats.Processed),
+			formatNumber(stats.Rewritten),
+			formatNumber(stats.Relayed),
+			formatNumber(stats.Dropped),
+			formatNumber(stats.Missed),
+			formatNumber(stats.Overflow),
+			formatNumber(stats.Queued),
+			formatNumber(stats.KernelDrops),
+		)
+		<-ticker.C
+	}
+}
+
+// ruleCounters are the stats of a single rule, updated atomically by the workers
+type ruleCounters struct {
+	matches      int64
+	drops        int64
+	relays       int64
+	zeroCaptures int64
+	lastMatch    int64 // unix nanoseconds
+	latency      int64 // total nanoseconds spent finding this rule for the metrics it decided
+}
+
+// record counts a metric decided by the rule, started is when the rule evaluation began
+func (c *ruleCounters) record(action string, started time.Time) {
+	now := time.Now()
+
+	switch action {
+	case ruleActionMatch:
+		atomic.AddInt64(&c.matches, 1)
+	case ruleActionDrop:
+		atomic.AddInt64(&c.drops, 1)
+	case ruleActionRelay:
+		atomic.AddInt64(&c.relays, 1)
+	}
+
+	atomic.AddInt64(&c.latency, int64(now.Sub(started)))
+	atomic.StoreInt64(&c.lastMatch, now.UnixNano())
+}
+
+// recordZeroCaptures counts a match that was skipped because it captured nothing
+func (c *ruleCounters) recordZeroCaptures() {
+	atomic.AddInt64(&c.zeroCaptures, 1)
+}
+
+// RuleStats is a point-in-time copy of a rule's counters
+type RuleStats struct {
+	Index        int        `json:"index"`
+	Pattern      string     `json:"pattern"`
+	Action       string     `json:"action"`
+	Name         string     `json:"name,omitempty"`
+	Upstreams    []string   `json:"upstreams,omitempty"`
+	Hits         int64      `json:"hits"`
+	Matches      int64      `json:"matches"`
+	Drops        int64      `json:"drops"`
+	Relays       int64      `json:"relays"`
+	ZeroCaptures int64      `json:"zero_captures"`
+	LastMatch    *time.Time `json:"last_match"`
+	AvgLatencyUS float64    `json:"avg_latency_us"`
+}
+
+func (r *Rule) takeStats(index int) RuleStats {
+	stats := RuleStats{
+		Index:        index,
+		Pattern:      r.pattern,
+		Action:       r.action,
+		Name:         r.name,
+		Upstreams:    r.upstreams(),
+		Matches:      atomic.LoadInt64(&r.stats.matches),
+		Drops:        atomic.LoadInt64(&r.stats.drops),
+		Relays:       atomic.LoadInt64(&r.stats.relays),
+		ZeroCaptures: atomic.LoadInt64(&r.stats.zeroCaptures),
+	}
+	stats.Hits = stats.Matches + stats.Drops + stats.Relays
+
+	if lastMatch := atomic.LoadInt64(&r.stats.lastMatch); lastMatch > 0 {
+		t := time.Unix(0, lastMatch)
+		stats.LastMatch = &t
+	}
+
+	if stats.Hits > 0 {
+		stats.AvgLatencyUS = float64(atomic.LoadInt64(&r.stats.latency)) / float64(stats.Hits) / float64(time.Microsecond)
+	}
+
+	return stats
+}
+
+// showRuleStats lists the active rules in evaluation order with their stats,
+// which are reset whenever the rules are reloaded
+func showRuleStats(w http.ResponseWriter, r *http.Request) {
+	ruleSet := currentRules()
+
+	response := struct {
+		Generation int64       `json:"generation"`
+		Rules      []RuleStats `json:"rules"`
+	}{
+		Generation: ruleSet.generation,
+		Rules:      make([]RuleStats, 0, len(ruleSet.list)),
+	}
+
+	for i, rule := range ruleSet.list {
+		response.Rules = append(response.Rules, rule.takeStats(i))
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
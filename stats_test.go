@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleStats(t *testing.T) {
+	ruleSet, err := parseRules([]byte(`
+rules:
+  - { pattern: "app.requests", action: match, name: "app.hits" }
+  - { pattern: "app.{service}.requests", action: match, name: "app.requests" }
+  - { pattern: "app.*", action: relay, upstreams: [aggregator] }
+  - { pattern: "debug.*", action: drop }
+  - { pattern: "unused.*", action: drop }
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleSet.generation = 7
+
+	for _, name := range []string{"app.requests", "app.web.requests", "app.api.requests", "app.runtime.heap", "debug.a", "debug.b", "debug.c", "other"} {
+		ruleSet.Resolve(name)
+	}
+
+	// app.requests has no captures, so it's relayed by the next rule that matches it
+	expected := []RuleStats{
+		{Index: 0, Action: ruleActionMatch, Name: "app.hits", ZeroCaptures: 1},
+		{Index: 1, Action: ruleActionMatch, Name: "app.requests", Hits: 2, Matches: 2},
+		{Index: 2, Action: ruleActionRelay, Upstreams: []string{"aggregator"}, Hits: 2, Relays: 2},
+		{Index: 3, Action: ruleActionDrop, Hits: 3, Drops: 3},
+		{Index: 4, Action: ruleActionDrop},
+	}
+
+	defer func(rules *Rules) { activeRules.Store(rules) }(currentRules())
+	activeRules.Store(ruleSet)
+
+	recorder := httptest.NewRecorder()
+	showRuleStats(recorder, httptest.NewRequest("GET", "/rules", nil))
+
+	var response struct {
+		Generation int64       `json:"generation"`
+		Rules      []RuleStats `json:"rules"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Generation != 7 || len(response.Rules) != len(expected) {
+		t.Fatalf("expected generation 7 with %d rules, got %d with %d", len(expected), response.Generation, len(response.Rules))
+	}
+
+	for i, stats := range response.Rules {
+		want := expected[i]
+		if stats.Index != want.Index || stats.Action != want.Action || stats.Name != want.Name || len(stats.Upstreams) != len(want.Upstreams) ||
+			stats.Hits != want.Hits || stats.Matches != want.Matches || stats.Drops != want.Drops || stats.Relays != want.Relays ||
+			stats.ZeroCaptures != want.ZeroCaptures {
+			t.Errorf("rule #%d: expected %+v, got %+v", i, want, stats)
+		}
+
+		// only rules that decided a metric have a last match and a latency
+		if (stats.LastMatch != nil) != (want.Hits > 0) || (stats.AvgLatencyUS > 0) != (want.Hits > 0) {
+			t.Errorf("rule #%d: expected a last match and latency only with hits, got %v and %f", i, stats.LastMatch, stats.AvgLatencyUS)
+		}
+	}
+}
+
+func TestStatsSnapshotConsistent(t *testing.T) {
+	before := takeStatsSnapshot()
+	outcomes := func(s StatsSnapshot) int64 { return s.Rewritten + s.Relayed + s.Dropped + s.Missed }
+
+	done := make(chan struct{})
+	for _, outcome := range []*expvar.Int{counterRewritten, counterRelayed, counterDropped, countersMissed} {
+		go func(outcome *expvar.Int) {
+			for i := 0; i < 10000; i++ {
+				countMetrics(2, outcome)
+			}
+			done <- struct{}{}
+		}(outcome)
+	}
+
+	for finished := 0; finished < 4; {
+		select {
+		case <-done:
+			finished++
+		default:
+		}
+
+		// every metric processed since the first snapshot has its outcome in the same snapshot
+		stats := takeStatsSnapshot()
+		if processed, counted := stats.Processed-before.Processed, outcomes(stats)-outcomes(before); processed != counted {
+			t.Fatalf("expected %d processed metrics to match their outcomes, got %d", counted, processed)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "strings"
+
+const (
+	tagConflictRule   = "rule"   // the tag captured by the rule replaces the incoming tag
+	tagConflictMetric = "metric" // the incoming tag is kept, the captured tag is discarded
+	tagConflictBoth   = "both"   // both tags are kept
+)
+
+// mergeTags combines the tags a metric arrived with and the tags captured by a rule,
+// resolving tags with the same key according to policy
+func mergeTags(metricTags, ruleTags []string, policy string) []string {
+	if len(metricTags) == 0 {
+		return ruleTags
+	}
+
+	if len(ruleTags) == 0 {
+		return metricTags
+	}
+
+	merged := make([]string, 0, len(metricTags)+len(ruleTags))
+
+	switch policy {
+	case tagConflictMetric:
+		keys := tagKeys(metricTags)
+		for _, tag := range ruleTags {
+			if !keys[tagKey(tag)] {
+				merged = append(merged, tag)
+			}
+		}
+		merged = append(merged, metricTags...)
+
+	case tagConflictBoth:
+		merged = append(merged, ruleTags...)
+		merged = append(merged, metricTags...)
+
+	default:
+		keys := tagKeys(ruleTags)
+		merged = append(merged, ruleTags...)
+		for _, tag := range metricTags {
+			if !keys[tagKey(tag)] {
+				merged = append(merged, tag)
+			}
+		}
+	}
+
+	return merged
+}
+
+// tagKey returns the key of a "key:value" tag, or the whole tag if it has no value
+func tagKey(tag string) string {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[:i]
+	}
+
+	return tag
+}
+
+func tagKeys(tags []string) map[string]bool {
+	keys := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		keys[tagKey(tag)] = true
+	}
+
+	return keys
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeTags(t *testing.T) {
+	metricTags := []string{"env:prod", "nomad_client:from-app", "canary"}
+	ruleTags := []string{"nomad_client:abc", "nomad_task:web"}
+
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{tagConflictRule, []string{"nomad_client:abc", "nomad_task:web", "env:prod", "canary"}},
+		{tagConflictMetric, []string{"nomad_task:web", "env:prod", "nomad_client:from-app", "canary"}},
+		{tagConflictBoth, []string{"nomad_client:abc", "nomad_task:web", "env:prod", "nomad_client:from-app", "canary"}},
+	}
+
+	for _, test := range tests {
+		if merged := mergeTags(metricTags, ruleTags, test.policy); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.policy, test.expected, merged)
+		}
+	}
+
+	if merged := mergeTags(nil, ruleTags, tagConflictRule); !reflect.DeepEqual(merged, ruleTags) {
+		t.Errorf("no metric tags: expected %v, got %v", ruleTags, merged)
+	}
+
+	if merged := mergeTags(metricTags, nil, tagConflictRule); !reflect.DeepEqual(merged, metricTags) {
+		t.Errorf("no rule tags: expected %v, got %v", metricTags, merged)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	counterTCPAccepted     = newCounter("tcp_connections_accepted")
+	counterTCPLinesTooLong = newCounter("tcp_lines_too_long")
+	counterTCPIdleTimeouts = newCounter("tcp_idle_timeouts")
+)
+
+// tcpConnections are the open connections of the TCP listener, listed on /tcp. It's never
+// replaced, as the HTTP server reads it while the listener starts.
+var tcpConnections = newConnectionSet()
+
+func init() {
+	statNames = append(statNames, "tcp_connections")
+	expvar.Publish("tcp_connections", expvar.Func(func() interface{} {
+		return tcpConnections.len()
+	}))
+}
+
+// tcpListener accepts long-lived TCP connections carrying newline-delimited StatsD lines.
+// Unlike UDP, a connection blocks when the worker queue is full instead of dropping lines.
+type tcpListener struct {
+	listener    net.Listener
+	maxLine     int
+	idleTimeout time.Duration
+	connections *connectionSet
+	conns       sync.WaitGroup
+}
+
+// tcpConnection is an open connection and its stats, which are updated atomically
+type tcpConnection struct {
+	conn      net.Conn
+	connected time.Time
+	lines     int64
+	bytes     int64
+	tooLong   int64
+	lastRead  int64 // unix nanoseconds
+}
+
+// newTCPListener listens for StatsD over TCP on the configured port
+func newTCPListener(cfg AppConfig) (Listener, error) {
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.TCPPort))
+	logger.Infof("Starting StatsD TCP listener on %s", address)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpListener{
+		listener:    listener,
+		maxLine:     cfg.TCPMaxLine,
+		idleTimeout: cfg.TCPIdleTimeout,
+		connections: tcpConnections,
+	}, nil
+}
+
+// Serve accepts connections until the listener is closed, then waits for them to finish
+func (l *tcpListener) Serve() {
+	defer listenersDone.Done()
+	defer l.conns.Wait()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				return
+			}
+
+			logger.Errorf("Error ACCEPT: %s", err)
+			continue
+		}
+
+		counterTCPAccepted.Add(1)
+		c := &tcpConnection{conn: conn, connected: time.Now()}
+		if !l.connections.add(c) {
+			// accepted while the listener was closing
+			conn.Close()
+			continue
+		}
+
+		l.conns.Add(1)
+		go l.handle(c)
+	}
+}
+
+// Close stops accepting connections and closes the open ones, lines already read are still queued
+func (l *tcpListener) Close() error {
+	err := l.listener.Close()
+	l.connections.closeAll()
+
+	return err
+}
+
+// handle reads lines from a connection until it's closed, or idle for longer than the idle timeout.
+// Lines are queued in packets, which are sent once full or when no more data is waiting to be read.
+func (l *tcpListener) handle(c *tcpConnection) {
+	defer l.conns.Done()
+	defer l.connections.remove(c)
+	defer c.conn.Close()
+
+	reader := bufio.NewReaderSize(c.conn, l.maxLine)
+	packet := getPacketBuffer(0)
+	skipping := false
+
+	for {
+		if l.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(l.idleTimeout))
+		}
+
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			atomic.AddInt64(&c.bytes, int64(len(line)))
+			atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			// the line is longer than the reader buffer, skip it up to the next newline
+			if !skipping {
+				skipping = true
+				atomic.AddInt64(&c.tooLong, 1)
+				counterTCPLinesTooLong.Add(1)
+				logger.Warnf("Dropping a line longer than %d bytes from %s", l.maxLine, c.conn.RemoteAddr())
+			}
+			continue
+		case skipping:
+			// the end of the line that was too long
+			skipping = false
+		case len(line) > 0:
+			if len(*packet)+len(line)+1 > UDP_MAX_PACKET_SIZE {
+				enqueuePacket(packet)
+				packet = getPacketBuffer(0)
+			}
+
+			*packet = append(*packet, line...)
+			if line[len(line)-1] != '\n' {
+				// the connection ended without a final newline
+				*packet = append(*packet, '\n')
+			}
+			atomic.AddInt64(&c.lines, 1)
+		}
+
+		if len(*packet) > 0 && (err != nil || reader.Buffered() == 0) {
+			enqueuePacket(packet)
+			packet = getPacketBuffer(0)
+		}
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				counterTCPIdleTimeouts.Add(1)
+				logger.Debugf("Closing idle TCP connection from %s", c.conn.RemoteAddr())
+			}
+			break
+		}
+	}
+
+	putPacketBuffer(packet)
+}
+
+// enqueuePacket queues a packet for the workers, waiting for room in the queue if it's full
+func enqueuePacket(packet *[]byte) {
+	workerChannel <- packet
+}
+
+// connectionSet tracks the open TCP connections
+type connectionSet struct {
+	sync.Mutex
+	conns  map[*tcpConnection]struct{}
+	closed bool
+}
+
+func newConnectionSet() *connectionSet {
+	return &connectionSet{conns: make(map[*tcpConnection]struct{})}
+}
+
+// add tracks a new connection, unless the set was closed
+func (s *connectionSet) add(c *tcpConnection) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *connectionSet) remove(c *tcpConnection) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.conns, c)
+}
+
+func (s *connectionSet) len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.conns)
+}
+
+// closeAll closes every open connection, which ends their handlers, and refuses new ones
+func (s *connectionSet) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// TCPConnectionStats is a point-in-time copy of a connection's stats
+type TCPConnectionStats struct {
+	Remote    string     `json:"remote"`
+	Connected time.Time  `json:"connected"`
+	Lines     int64      `json:"lines"`
+	Bytes     int64      `json:"bytes"`
+	TooLong   int64      `json:"lines_too_long"`
+	LastRead  *time.Time `json:"last_read"`
+}
+
+func (c *tcpConnection) takeStats() TCPConnectionStats {
+	stats := TCPConnectionStats{
+		Remote:    c.conn.RemoteAddr().String(),
+		Connected: c.connected,
+		Lines:     atomic.LoadInt64(&c.lines),
+		Bytes:     atomic.LoadInt64(&c.bytes),
+		TooLong:   atomic.LoadInt64(&c.tooLong),
+	}
+
+	if lastRead := atomic.LoadInt64(&c.lastRead); lastRead > 0 {
+		t := time.Unix(0, lastRead)
+		stats.LastRead = &t
+	}
+
+	return stats
+}
+
+// showTCPConnections lists the open TCP connections with their stats, oldest first
+func showTCPConnections(w http.ResponseWriter, r *http.Request) {
+	set := tcpConnections
+
+	set.Lock()
+	connections := make([]TCPConnectionStats, 0, len(set.conns))
+	for c := range set.conns {
+		connections = append(connections, c.takeStats())
+	}
+	set.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Connected.Before(connections[j].Connected)
+	})
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Connections []TCPConnectionStats `json:"connections"`
+	}{connections})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTCPListener(t *testing.T, idleTimeout time.Duration) (*tcpListener, string) {
+	cfg := defaultConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.TCPMaxLine = 32
+	cfg.TCPIdleTimeout = idleTimeout
+
+	listener, err := newTCPListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every test gets its own connections, closing the listener closes the set for good
+	l := listener.(*tcpListener)
+	l.connections = newConnectionSet()
+
+	listenersDone.Add(1)
+	go l.Serve()
+
+	return l, l.listener.Addr().String()
+}
+
+func TestTCPListener(t *testing.T) {
+	workerChannel = make(chan *[]byte, 10)
+	listener, address := startTCPListener(t, 0)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"a.b:1|c\n",
+		"too.long:1|c|#" + strings.Repeat("x", 100) + "\n",
+		"c.d:2|g\r\n",
+		"e.f:3|ms", // no final newline
+	}
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	received := ""
+	for !strings.Contains(received, "e.f") {
+		select {
+		case packet := <-workerChannel:
+			received = received + string(*packet)
+		case <-time.After(time.Second):
+			t.Fatalf("expected all lines, got %q", received)
+		}
+	}
+
+	if expected := "a.b:1|c\nc.d:2|g\r\ne.f:3|ms\n"; received != expected {
+		t.Errorf("expected %q, got %q", expected, received)
+	}
+
+	listener.Close()
+	listenersDone.Wait()
+}
+
+func TestTCPListenerIdleTimeout(t *testing.T) {
+	workerChannel = make(chan *[]byte, 10)
+	listener, address := startTCPListener(t, 50*time.Millisecond)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+
+	listener.Close()
+	listenersDone.Wait()
+}
+
+func TestTCPListenerClose(t *testing.T) {
+	workerChannel = make(chan *[]byte, 10)
+	listener, address := startTCPListener(t, 0)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("a.b:1|c\n"))
+	select {
+	case <-workerChannel:
+	case <-time.After(time.Second):
+		t.Fatal("expected a packet")
+	}
+
+	// closing the listener ends the open connections
+	listener.Close()
+	listenersDone.Wait()
+
+	if n := listener.connections.len(); n != 0 {
+		t.Errorf("expected no open connections, got %d", n)
+	}
+}
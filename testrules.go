@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RuleFixture is a StatsD line with the outcome the rules are expected to produce for it
+type RuleFixture struct {
+	Line   string    `yaml:"line"`
+	Rule   string    `yaml:"rule,omitempty"`
+	Action string    `yaml:"action,omitempty"`
+	Name   string    `yaml:"name,omitempty"`
+	Tags   *[]string `yaml:"tags,omitempty"`
+}
+
+// testRules implements the "test-rules" subcommand, which runs StatsD lines through
+// the rules without opening any sockets, and returns the process exit code
+func testRules(args []string) int {
+	flags := flag.NewFlagSet("test-rules", flag.ContinueOnError)
+	fixturesPath := flags.String("fixtures", "", "Path to a YAML file of lines with expected outcomes (default: read lines from stdin)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s test-rules [--config config.yaml] [--rules rules.yaml] [--fixtures fixtures.yaml] < sample.txt\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	// the same configuration as the proxy, so the outcomes are the ones it would have
+	cfg, err := parseConfig(flags, args)
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		return 2
+	}
+	config = cfg
+
+	ruleSet, err := loadRules(config.RulesFile)
+	if err == nil {
+		err = ruleSet.checkUpstreams(config.upstreams())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load rules: %s\n", err)
+		return 2
+	}
+
+	var fixtures []RuleFixture
+	if *fixturesPath != "" {
+		fixtures, err = loadRuleFixtures(*fixturesPath)
+	} else {
+		fixtures, err = readRuleFixtures(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read input: %s\n", err)
+		return 2
+	}
+
+	failures := 0
+	for _, fixture := range fixtures {
+		for _, problem := range runRuleFixture(ruleSet, fixture, os.Stdout) {
+			fmt.Fprintf(os.Stdout, "  FAIL: %s\n", problem)
+			failures = failures + 1
+		}
+	}
+
+	if failures > 0 {
+		fmt.Fprintf(os.Stdout, "\n%d expectations not met\n", failures)
+		return 1
+	}
+
+	return 0
+}
+
+// loadRuleFixtures reads a YAML list of fixtures
+func loadRuleFixtures(path string) ([]RuleFixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := make([]RuleFixture, 0)
+	if err := yaml.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("Could not parse fixtures %s: %s", path, err)
+	}
+
+	return fixtures, nil
+}
+
+// readRuleFixtures reads plain StatsD lines, without any expectations
+func readRuleFixtures(r io.Reader) ([]RuleFixture, error) {
+	fixtures := make([]RuleFixture, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, UDP_MAX_PACKET_SIZE), UDP_MAX_PACKET_SIZE)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fixtures = append(fixtures, RuleFixture{Line: line})
+	}
+
+	return fixtures, scanner.Err()
+}
+
+// runRuleFixture parses and resolves a fixture line exactly like the workers do, prints
+// the outcome for each metric on the line, and returns the expectations that were not met
+func runRuleFixture(ruleSet *Rules, fixture RuleFixture, out io.Writer) []string {
+	fmt.Fprintln(out, fixture.Line)
+
+	event := isEventOrServiceCheck(fixture.Line)
+
+	var metrics []*StatsDMetric
+	var err error
+	if event {
+		metrics, err = parseEventName(fixture.Line)
+	} else {
+		metrics, err = parsePacketString(fixture.Line)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "  error: %s\n", err)
+		if fixture.Action != "" {
+			return []string{fmt.Sprintf("expected action '%s', but the line could not be parsed", fixture.Action)}
+		}
+		return nil
+	}
+
+	problems := make([]string, 0)
+	for _, metric := range metrics {
+		index, result := ruleSet.Resolve(metric.name)
+
+		pattern := ""
+		if index >= 0 {
+			pattern = ruleSet.list[index].pattern
+			fmt.Fprintf(out, "  rule:   #%d %s\n", index+1, pattern)
+		} else {
+			fmt.Fprintln(out, "  rule:   (none)")
+		}
+
+		// the same name and tags the workers would emit
+		name, tags := metric.name, metric.tags
+		if result.action == ruleActionMatch {
+			tags = mergeTags(metric.tags, result.Tags, config.TagConflict)
+
+			// events and service checks only get the tags
+			if !event {
+				name = result.name
+			}
+		}
+
+		tags = append([]string{}, tags...)
+		sort.Strings(tags)
+
+		fmt.Fprintf(out, "  action: %s\n", result.action)
+		if result.action == ruleActionMiss && !event && !config.RelayUnmatched {
+			fmt.Fprintln(out, "  dropped: no rule matched, set relay_unmatched to relay it")
+		} else if result.action == ruleActionMatch || result.action == ruleActionRelay || result.action == ruleActionMiss {
+			fmt.Fprintf(out, "  name:   %s\n", name)
+		}
+		if len(tags) > 0 {
+			fmt.Fprintf(out, "  tags:   %s\n", strings.Join(tags, ","))
+		}
+		if result.destination != "" && result.action != ruleActionDrop {
+			fmt.Fprintf(out, "  to:     %s\n", result.destination)
+		}
+
+		if fixture.Rule != "" && fixture.Rule != pattern {
+			problems = append(problems, fmt.Sprintf("expected rule '%s', got '%s'", fixture.Rule, pattern))
+		}
+
+		if fixture.Action != "" && fixture.Action != result.action {
+			problems = append(problems, fmt.Sprintf("expected action '%s', got '%s'", fixture.Action, result.action))
+		}
+
+		if fixture.Name != "" && fixture.Name != name {
+			problems = append(problems, fmt.Sprintf("expected name '%s', got '%s'", fixture.Name, name))
+		}
+
+		if fixture.Tags != nil {
+			expected := append([]string{}, *fixture.Tags...)
+			sort.Strings(expected)
+
+			if strings.Join(expected, ",") != strings.Join(tags, ",") {
+				problems = append(problems, fmt.Sprintf("expected tags '%s', got '%s'", strings.Join(expected, ","), strings.Join(tags, ",")))
+			}
+		}
+	}
+
+	return problems
+}
+
+// parseEventName returns an event or service check as a metric with just the name the rules see and its tags
+func parseEventName(line string) ([]*StatsDMetric, error) {
+	if strings.HasPrefix(line, eventPrefix) {
+		event, err := parseEventString(line)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*StatsDMetric{{name: event.Title, tags: event.Tags}}, nil
+	}
+
+	check, err := parseServiceCheckString(line)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*StatsDMetric{{name: check.Name, tags: check.Tags}}, nil
+}